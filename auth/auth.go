@@ -1,23 +1,196 @@
 package auth
 
 import (
+	"crypto/rand"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// DefaultJWTSecret is used when JWT_SECRET is not set
+const DefaultJWTSecret = "atlassian_proxy_jwt_secret"
+
+// keySet holds the signing key and every key accepted for verification, by key ID
+type keySet struct {
+	method     jwt.SigningMethod
+	signKey    interface{}
+	signKID    string
+	verifyKeys map[string]interface{}
+	retireAt   map[string]time.Time // Verify keys accepted only until the given time
+}
+
 var (
-	// JWT secret key, should be read from environment variables or config file
-	jwtSecret = []byte("atlassian_proxy_jwt_secret")
+	// JWT keys, loaded from the environment (JWT_ALGORITHM, JWT_SECRET, ...) by Init
+	keysMu sync.RWMutex
+	keys   *keySet
 
 	// JWT expiration time
 	tokenExpiration = 24 * time.Hour
 )
 
+// ErrKeysNotLoaded is returned when tokens are used before Init has loaded the keys
+var ErrKeysNotLoaded = errors.New("JWT keys not loaded")
+
+// Init loads the JWT keys from the environment. It must succeed before tokens
+// are issued or parsed; on failure the previously loaded keys are kept.
+func Init() error {
+	ks, err := loadKeySet()
+	if err != nil {
+		return fmt.Errorf("failed to load JWT keys: %w", err)
+	}
+	keysMu.Lock()
+	keys = ks
+	keysMu.Unlock()
+	return nil
+}
+
+func jwtSecretFromEnv() string {
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		return secret
+	}
+	return DefaultJWTSecret
+}
+
+// Algorithm returns the configured JWT signing algorithm
+func Algorithm() string {
+	if alg := strings.ToUpper(os.Getenv("JWT_ALGORITHM")); alg != "" {
+		return alg
+	}
+	return "HS256"
+}
+
+// loadKeySet builds the key set for the configured algorithm.
+//
+// HS256 signs with JWT_SECRET and also accepts JWT_PREVIOUS_SECRETS (comma-separated).
+// RS256 signs with the PEM private key in JWT_PRIVATE_KEY_FILE and also accepts
+// the PEM public keys listed in JWT_PREVIOUS_PUBLIC_KEY_FILES (comma-separated).
+func loadKeySet() (*keySet, error) {
+	switch alg := Algorithm(); alg {
+	case "HS256":
+		secret := []byte(jwtSecretFromEnv())
+		ks := &keySet{
+			method:     jwt.SigningMethodHS256,
+			signKey:    secret,
+			signKID:    keyID(secret),
+			verifyKeys: map[string]interface{}{keyID(secret): secret},
+		}
+		for _, prev := range splitList(os.Getenv("JWT_PREVIOUS_SECRETS")) {
+			ks.verifyKeys[keyID([]byte(prev))] = []byte(prev)
+		}
+		return ks, nil
+
+	case "RS256":
+		path := os.Getenv("JWT_PRIVATE_KEY_FILE")
+		if path == "" {
+			return nil, errors.New("JWT_PRIVATE_KEY_FILE is required for RS256")
+		}
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read private key: %w", err)
+		}
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("parse private key: %w", err)
+		}
+		der, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("marshal public key: %w", err)
+		}
+		ks := &keySet{
+			method:     jwt.SigningMethodRS256,
+			signKey:    privateKey,
+			signKID:    keyID(der),
+			verifyKeys: map[string]interface{}{keyID(der): &privateKey.PublicKey},
+		}
+		for _, prevPath := range splitList(os.Getenv("JWT_PREVIOUS_PUBLIC_KEY_FILES")) {
+			pemBytes, err := os.ReadFile(prevPath)
+			if err != nil {
+				return nil, fmt.Errorf("read previous public key %s: %w", prevPath, err)
+			}
+			publicKey, err := jwt.ParseRSAPublicKeyFromPEM(pemBytes)
+			if err != nil {
+				return nil, fmt.Errorf("parse previous public key %s: %w", prevPath, err)
+			}
+			der, err := x509.MarshalPKIXPublicKey(publicKey)
+			if err != nil {
+				return nil, fmt.Errorf("marshal previous public key %s: %w", prevPath, err)
+			}
+			ks.verifyKeys[keyID(der)] = publicKey
+		}
+		return ks, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported JWT_ALGORITHM %q", alg)
+	}
+}
+
+// ErrRotationUnsupported is returned when rotating keys that are not a shared secret
+var ErrRotationUnsupported = errors.New("runtime secret rotation requires JWT_ALGORITHM=HS256")
+
+// GenerateSecret returns a new random HS256 signing secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// SetSecret replaces the HS256 signing secret. Tokens signed with the previous
+// secret keep validating for the grace period, so existing sessions end
+// gradually rather than all at once; other previously accepted secrets are
+// dropped. A grace of 0 invalidates every earlier token immediately.
+func SetSecret(secret string, grace time.Duration) error {
+	if Algorithm() != "HS256" {
+		return ErrRotationUnsupported
+	}
+	if secret == "" {
+		return errors.New("secret must not be empty")
+	}
+
+	key := []byte(secret)
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	ks := &keySet{
+		method:     jwt.SigningMethodHS256,
+		signKey:    key,
+		signKID:    keyID(key),
+		verifyKeys: map[string]interface{}{keyID(key): key},
+		retireAt:   map[string]time.Time{},
+	}
+	if grace > 0 && keys != nil && keys.signKID != ks.signKID {
+		ks.verifyKeys[keys.signKID] = keys.signKey
+		ks.retireAt[keys.signKID] = time.Now().Add(grace)
+	}
+	keys = ks
+	return nil
+}
+
+// keyID derives a short, stable identifier for a key
+func keyID(material []byte) string {
+	sum := sha256.Sum256(material)
+	return hex.EncodeToString(sum[:8])
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // Claims custom JWT claims
 type Claims struct {
 	jwt.RegisteredClaims
@@ -26,6 +199,13 @@ type Claims struct {
 
 // GenerateToken generates a JWT token
 func GenerateToken(userID uint) (string, error) {
+	keysMu.RLock()
+	ks := keys
+	keysMu.RUnlock()
+	if ks == nil {
+		return "", ErrKeysNotLoaded
+	}
+
 	// Create claims
 	claims := Claims{
 		RegisteredClaims: jwt.RegisteredClaims{
@@ -36,23 +216,39 @@ func GenerateToken(userID uint) (string, error) {
 		UserID: userID,
 	}
 
-	// Create token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	// Create token, tagged with the signing key ID so verification can pick the right key
+	token := jwt.NewWithClaims(ks.method, claims)
+	token.Header["kid"] = ks.signKID
 
 	// Sign token
-	return token.SignedString(jwtSecret)
+	return token.SignedString(ks.signKey)
 }
 
 // ParseToken parses a JWT token
 func ParseToken(tokenString string) (*Claims, error) {
-	// Parse token
+	keysMu.RLock()
+	ks := keys
+	keysMu.RUnlock()
+	if ks == nil {
+		return nil, ErrKeysNotLoaded
+	}
+
+	// Parse token, accepting only the configured algorithm to prevent alg confusion
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		// Verify signing method
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			// Tokens issued before key IDs were introduced
+			kid = ks.signKID
+		}
+		key, ok := ks.verifyKeys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key: %s", kid)
+		}
+		if until, retiring := ks.retireAt[kid]; retiring && time.Now().After(until) {
+			return nil, fmt.Errorf("signing key retired: %s", kid)
 		}
-		return jwtSecret, nil
-	})
+		return key, nil
+	}, jwt.WithValidMethods([]string{ks.method.Alg()}))
 
 	if err != nil {
 		return nil, err
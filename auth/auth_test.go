@@ -0,0 +1,224 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// useKeys loads the key set from env with Init for the duration of a test
+func useKeys(t *testing.T, env map[string]string) error {
+	t.Helper()
+	for _, key := range []string{"JWT_ALGORITHM", "JWT_SECRET", "JWT_PREVIOUS_SECRETS", "JWT_PRIVATE_KEY_FILE", "JWT_PREVIOUS_PUBLIC_KEY_FILES"} {
+		t.Setenv(key, env[key])
+	}
+	keysMu.RLock()
+	old := keys
+	keysMu.RUnlock()
+	t.Cleanup(func() {
+		keysMu.Lock()
+		keys = old
+		keysMu.Unlock()
+	})
+	return Init()
+}
+
+// writeRSAKey writes a new RSA key pair as PEM files and returns their paths
+func writeRSAKey(t *testing.T) (privatePath, publicPath string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	privatePath = filepath.Join(dir, "private.pem")
+	publicPath = filepath.Join(dir, "public.pem")
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), 0600)
+	os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644)
+	return privatePath, publicPath
+}
+
+// issue signs a token with the key set loaded from env
+func issue(t *testing.T, env map[string]string) string {
+	t.Helper()
+	if err := useKeys(t, env); err != nil {
+		t.Fatal(err)
+	}
+	token, err := GenerateToken(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldPrivate, oldPublic := writeRSAKey(t)
+	newPrivate, _ := writeRSAKey(t)
+
+	tests := []struct {
+		name    string
+		signer  map[string]string
+		parser  map[string]string
+		wantErr bool
+	}{
+		{"HS256 same secret", map[string]string{"JWT_SECRET": "a"}, map[string]string{"JWT_SECRET": "a"}, false},
+		{"HS256 rotated without previous", map[string]string{"JWT_SECRET": "a"}, map[string]string{"JWT_SECRET": "b"}, true},
+		{"HS256 previous secret accepted", map[string]string{"JWT_SECRET": "a"},
+			map[string]string{"JWT_SECRET": "b", "JWT_PREVIOUS_SECRETS": "x, a"}, false},
+		{"RS256 same key", map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": oldPrivate},
+			map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": oldPrivate}, false},
+		{"RS256 rotated without previous", map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": oldPrivate},
+			map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": newPrivate}, true},
+		{"RS256 previous public key accepted", map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": oldPrivate},
+			map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": newPrivate, "JWT_PREVIOUS_PUBLIC_KEY_FILES": oldPublic}, false},
+		{"HS256 token rejected under RS256", map[string]string{"JWT_SECRET": "a"},
+			map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": oldPrivate}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := issue(t, tt.signer)
+			if err := useKeys(t, tt.parser); err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := ParseToken(token)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseToken() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && claims.UserID != 7 {
+				t.Errorf("user ID = %d, want 7", claims.UserID)
+			}
+		})
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"unsupported algorithm", map[string]string{"JWT_ALGORITHM": "ES256"}},
+		{"RS256 without a key", map[string]string{"JWT_ALGORITHM": "RS256"}},
+		{"RS256 missing key file", map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": "/nonexistent.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := useKeys(t, tt.env); err == nil {
+				t.Error("Init() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestParseTokenRejectsNoneAlgorithm(t *testing.T) {
+	if err := useKeys(t, map[string]string{"JWT_SECRET": "a"}); err != nil {
+		t.Fatal(err)
+	}
+	claims := Claims{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}, UserID: 1}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseToken(token); err == nil {
+		t.Error("ParseToken accepted an unsigned token")
+	}
+}
+
+func TestSetSecret(t *testing.T) {
+	tests := []struct {
+		name       string
+		grace      time.Duration
+		wait       time.Duration
+		wantOldErr bool
+	}{
+		{"old tokens rejected without grace", 0, 0, true},
+		{"old tokens accepted during grace", time.Minute, 0, false},
+		{"old tokens rejected once grace ends", 10 * time.Millisecond, 30 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldToken := issue(t, map[string]string{"JWT_SECRET": "old"})
+
+			if err := SetSecret("new", tt.grace); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(tt.wait)
+
+			if _, err := ParseToken(oldToken); (err != nil) != tt.wantOldErr {
+				t.Errorf("ParseToken(old) error = %v, want error %v", err, tt.wantOldErr)
+			}
+			newToken, err := GenerateToken(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := ParseToken(newToken); err != nil {
+				t.Errorf("ParseToken(new) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestSetSecretErrors(t *testing.T) {
+	privatePath, _ := writeRSAKey(t)
+	tests := []struct {
+		name   string
+		env    map[string]string
+		secret string
+	}{
+		{"empty secret", map[string]string{"JWT_SECRET": "a"}, ""},
+		{"RS256 keys", map[string]string{"JWT_ALGORITHM": "RS256", "JWT_PRIVATE_KEY_FILE": privatePath}, "new"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := useKeys(t, tt.env); err != nil {
+				t.Fatal(err)
+			}
+			if err := SetSecret(tt.secret, 0); err == nil {
+				t.Error("SetSecret() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if len(a) != 64 || a == b {
+		t.Errorf("GenerateSecret() = %q, %q; want distinct 64-character secrets", a, b)
+	}
+}
+
+func TestTokensRequireInit(t *testing.T) {
+	keysMu.Lock()
+	old := keys
+	keys = nil
+	keysMu.Unlock()
+	t.Cleanup(func() {
+		keysMu.Lock()
+		keys = old
+		keysMu.Unlock()
+	})
+
+	if _, err := GenerateToken(7); !errors.Is(err, ErrKeysNotLoaded) {
+		t.Errorf("GenerateToken() error = %v, want ErrKeysNotLoaded", err)
+	}
+	if _, err := ParseToken("token"); !errors.Is(err, ErrKeysNotLoaded) {
+		t.Errorf("ParseToken() error = %v, want ErrKeysNotLoaded", err)
+	}
+}
@@ -1,40 +1,162 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-resty/resty/v2"
 )
 
+// upstreamTrace records which credential FetchWithRetry settled on, for
+// callers that put one in the request context with withUpstreamTrace
+type upstreamTrace struct {
+	credentialIndex int // Position in Credentials, or -1 if no attempt succeeded
+}
+
+type upstreamTraceKey struct{}
+
+// withUpstreamTrace returns a context carrying a trace that FetchWithRetry fills in
+func withUpstreamTrace(ctx context.Context) (context.Context, *upstreamTrace) {
+	trace := &upstreamTrace{credentialIndex: -1}
+	return context.WithValue(ctx, upstreamTraceKey{}, trace), trace
+}
+
 // HTTPClient wraps resty client with retry logic
 type HTTPClient struct {
 	client *resty.Client
 }
 
+// SharedHTTPClient returns the process-wide upstream client, so keep-alive
+// connections to the gateway are reused across requests
+var SharedHTTPClient = sync.OnceValue(NewHTTPClient)
+
 // NewHTTPClient creates a new HTTP client
 func NewHTTPClient() *HTTPClient {
-	client := resty.New()
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = UpstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = UpstreamIdleConnTimeout
+
+	client := resty.NewWithClient(&http.Client{Transport: transport})
 	client.SetTimeout(0) // No timeout for streaming
 	client.SetRedirectPolicy(resty.FlexibleRedirectPolicy(10))
 
+	// An explicit upstream proxy (credentials may be embedded in the URL) takes
+	// precedence; otherwise resty's default transport honors HTTPS_PROXY/HTTP_PROXY/NO_PROXY
+	if UpstreamProxy != "" {
+		client.SetProxy(UpstreamProxy)
+	}
+
 	return &HTTPClient{
 		client: client,
 	}
 }
 
+// rotationCursor advances on every request so load is spread round-robin across credentials
+var rotationCursor atomic.Uint64
+
+// startCredentialIndex picks the credential a request tries first according to CREDENTIAL_STRATEGY
+func startCredentialIndex(credentials []Credential) int {
+	switch CredentialStrategy {
+	case "priority":
+		return 0
+	case "weighted":
+		if idx, ok := weightedCredentialIndex(credentials); ok {
+			return idx
+		}
+	}
+	return int((rotationCursor.Add(1) - 1) % uint64(len(credentials)))
+}
+
+// weightedCredentialIndex picks a credential at random in proportion to its weight.
+// Zero-weight credentials are never picked; ok is false if every weight is zero.
+func weightedCredentialIndex(credentials []Credential) (idx int, ok bool) {
+	total := 0
+	for _, cred := range credentials {
+		total += max(cred.Weight, 0)
+	}
+	if total == 0 {
+		return 0, false
+	}
+
+	r := rand.IntN(total)
+	for i, cred := range credentials {
+		if cred.Weight <= 0 {
+			continue
+		}
+		if r < cred.Weight {
+			return i, true
+		}
+		r -= cred.Weight
+	}
+	return 0, false
+}
+
+// ErrUpstreamUnavailable marks a failure caused by upstream server errors rather than auth problems
+var ErrUpstreamUnavailable = errors.New("upstream unavailable")
+
 // FetchWithRetry performs HTTP request with credential rotation and exponential backoff
 func (c *HTTPClient) FetchWithRetry(ctx context.Context, body AtlassianRequest, stream bool) (*resty.Response, error) {
 	delay := InitialDelay
 	attempts := 0
-	credIdx := 0
+	serverError := false
 
-	for attempts < len(Credentials) {
-		cred := Credentials[credIdx]
+	credentials := CredentialsForModel(body.PlatformAttributes.Model)
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no credentials configured for model %s", body.PlatformAttributes.Model)
+	}
+	credentials = preferHealthy(credentials)
+
+	// Start from the credential the strategy picks, then rotate on failure within this request
+	credIdx := startCredentialIndex(credentials)
+
+	// Total attempts are independent of the credential count so a single
+	// credential can still be retried on transient failures
+	maxAttempts := MaxRetries
+	if maxAttempts <= 0 {
+		maxAttempts = max(len(credentials), DefaultMinAttempts)
+	}
+
+	// Why each attempt failed, for the exhaustion warning
+	var failures []string
+
+	// No retry may start after this point (RETRY_BUDGET or the context deadline)
+	var retryDeadline time.Time
+	if RetryBudget > 0 {
+		retryDeadline = time.Now().Add(RetryBudget)
+	}
+	ctxDeadline := false
+	if deadline, ok := ctx.Deadline(); ok && (retryDeadline.IsZero() || deadline.Before(retryDeadline)) {
+		retryDeadline = deadline
+		ctxDeadline = true
+	}
+	budgetSpent := false
+
+	for attempts < maxAttempts {
+		// Move past credentials that are at their concurrency limit
+		idx, err := acquireCredential(ctx, credentials, credIdx)
+		if err != nil {
+			return nil, err
+		}
+		credIdx = idx
+		cred := credentials[credIdx]
 		headers := AuthHeaders(cred.Email, cred.Token)
+		credentialSelections.Inc(maskEmail(cred.Email))
 
 		req := c.client.R().
 			SetContext(ctx).
@@ -48,9 +170,42 @@ func (c *HTTPClient) FetchWithRetry(ctx context.Context, body AtlassianRequest,
 			req.SetDoNotParseResponse(true)
 		}
 
+		record := newDebugRecord(body, headers)
+
 		resp, err := req.Post(AtlassianAPIEndpoint)
 
+		if err != nil {
+			recordCredentialResult(cred.Email, 0, err)
+		} else {
+			recordCredentialResult(cred.Email, resp.StatusCode(), nil)
+			recordRateLimit(cred.Email, resp.StatusCode(), resp.Header())
+		}
 		if err == nil && resp.StatusCode() < 400 {
+			credentialSuccesses.Inc(maskEmail(cred.Email))
+		} else {
+			credentialFailures.Inc(maskEmail(cred.Email))
+		}
+
+		switch {
+		case err != nil:
+			record.WriteError(err)
+		case stream:
+			resp.RawResponse.Body = record.TeeBody(resp.StatusCode(), resp.RawResponse.Body)
+		default:
+			record.WriteResponse(resp.StatusCode(), resp.Body())
+		}
+
+		// A streamed response keeps its slot until the body is closed
+		if err == nil && stream {
+			resp.RawResponse.Body = &releaseOnClose{ReadCloser: resp.RawResponse.Body, email: cred.Email}
+		} else {
+			releaseCredential(cred.Email)
+		}
+
+		if err == nil && resp.StatusCode() < 400 {
+			if trace, ok := ctx.Value(upstreamTraceKey{}).(*upstreamTrace); ok {
+				trace.credentialIndex = slices.IndexFunc(loadedCredentials(), func(c Credential) bool { return c.Email == cred.Email })
+			}
 			return resp, nil
 		}
 
@@ -62,46 +217,156 @@ func (c *HTTPClient) FetchWithRetry(ctx context.Context, body AtlassianRequest,
 			}
 		}
 
-		if err != nil || resp.StatusCode() == 401 || resp.StatusCode() == 403 || resp.StatusCode() >= 500 {
+		// Auth failures, per-credential rate limits and server errors move on to the next credential
+		if err != nil || resp.StatusCode() == 401 || resp.StatusCode() == 403 || resp.StatusCode() == 429 || resp.StatusCode() >= 500 {
+			if err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", cred.Email, err))
+			} else {
+				failures = append(failures, fmt.Sprintf("%s: status %d", cred.Email, resp.StatusCode()))
+			}
+
+			// Release the unread stream body (and its debug record) before retrying
+			if err == nil && stream {
+				resp.RawBody().Close()
+			}
+			serverError = err != nil || resp.StatusCode() >= 500
+
+			credIdx = (credIdx + 1) % len(credentials)
+			attempts++
+			if attempts >= maxAttempts {
+				break
+			}
+
+			// Give up now rather than sleep into a retry that couldn't finish in time
+			wait := jitteredDelay(delay)
+			if !retryDeadline.IsZero() && time.Now().Add(wait).After(retryDeadline) {
+				if ctxDeadline {
+					return nil, fmt.Errorf("%w: no time left to retry after %d attempts", context.DeadlineExceeded, attempts)
+				}
+				budgetSpent = true
+				break
+			}
 
 			select {
 			case <-ctx.Done():
 				return nil, ctx.Err()
-			case <-time.After(delay):
+			case <-time.After(wait):
 			}
 
 			delay = time.Duration(float64(delay) * DelayMultiplier)
 			if delay > MaxDelay {
 				delay = MaxDelay
 			}
-
-			credIdx = (credIdx + 1) % len(Credentials)
-			attempts++
 		} else {
 
 			return resp, fmt.Errorf("non-retryable error: status %d", resp.StatusCode())
 		}
 	}
 
-	return nil, fmt.Errorf("all credentials exhausted after %d attempts", attempts)
+	credentialExhaustions.Inc()
+	log.Printf("WARN all credentials exhausted model=%s attempts=%d budget_spent=%t failures=[%s]",
+		body.PlatformAttributes.Model, attempts, budgetSpent, strings.Join(failures, "; "))
+
+	reason := fmt.Sprintf("all credentials exhausted after %d attempts", attempts)
+	if budgetSpent {
+		reason = fmt.Sprintf("retry budget spent after %d attempts", attempts)
+	}
+	if serverError {
+		return nil, fmt.Errorf("%w: %s", ErrUpstreamUnavailable, reason)
+	}
+	return nil, errors.New(reason)
+}
+
+// jitteredDelay applies equal jitter to a backoff delay, returning a random
+// duration in [delay/2, delay] so concurrent retries don't run in lockstep
+func jitteredDelay(delay time.Duration) time.Duration {
+	if delay > MaxDelay {
+		delay = MaxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int64N(int64(delay-half)+1))
 }
 
+// ErrStreamIdleTimeout is reported when the upstream stops sending data mid-stream
+var ErrStreamIdleTimeout = errors.New("upstream stream idle timeout")
+
 type StreamResponse struct {
-	Response *resty.Response
-	Model    string
+	Response     *resty.Response
+	Model        string
+	IncludeUsage bool // Emit a final usage chunk (stream_options.include_usage)
+
+	usageMu sync.Mutex
+	usage   ChatCompletionUsage // Latest usage reported by the upstream
+}
+
+// Usage returns the latest usage metrics reported by the upstream
+func (sr *StreamResponse) Usage() ChatCompletionUsage {
+	sr.usageMu.Lock()
+	defer sr.usageMu.Unlock()
+	return sr.usage
 }
 
 func (sr *StreamResponse) StreamLines(ctx context.Context) (<-chan []byte, <-chan error) {
 	linesChan := make(chan []byte, 10)
 	errChan := make(chan error, 1)
 
+	// The stream keeps the timeouts in effect when it started
+	firstByteTimeout, idleTimeout := StreamFirstByteTimeout, StreamIdleTimeout
+
 	go func() {
 		defer close(linesChan)
 		defer close(errChan)
 		defer sr.Response.RawBody().Close()
 
-		buffer := make([]byte, 4096)
-		var accumulated []byte
+		// Closing the body on cancellation unblocks a pending Read right away
+		stopOnCancel := context.AfterFunc(ctx, func() { sr.Response.RawBody().Close() })
+		defer stopOnCancel()
+
+		// Close the body if the upstream goes quiet for too long; this unblocks
+		// the pending Read without capping the total stream duration. A timeout
+		// of 0 disables the corresponding check.
+		var idleTimedOut atomic.Bool
+		var idleTimer *time.Timer
+		armIdleTimer := func(d time.Duration) {
+			switch {
+			case d <= 0:
+				if idleTimer != nil {
+					idleTimer.Stop()
+				}
+			case idleTimer == nil:
+				idleTimer = time.AfterFunc(d, func() {
+					idleTimedOut.Store(true)
+					sr.Response.RawBody().Close()
+				})
+			default:
+				idleTimer.Reset(d)
+			}
+		}
+		armIdleTimer(firstByteTimeout)
+		defer func() {
+			if idleTimer != nil {
+				idleTimer.Stop()
+			}
+		}()
+
+		body, err := decodedBody(sr.Response)
+		if err != nil {
+			if idleTimedOut.Load() {
+				err = ErrStreamIdleTimeout
+			}
+			errChan <- err
+			return
+		}
+
+		// Any bytes received count as activity for the idle timeout
+		reader := &activityReader{r: body, onRead: func() { armIdleTimer(idleTimeout) }}
+
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(make([]byte, 0, 4096), MaxSSEFrameSize)
+		scanner.Split(splitSSEFrames())
 
 		for {
 			select {
@@ -111,42 +376,27 @@ func (sr *StreamResponse) StreamLines(ctx context.Context) (<-chan []byte, <-cha
 			default:
 			}
 
-			n, err := sr.Response.RawBody().Read(buffer)
-			if n > 0 {
-				accumulated = append(accumulated, buffer[:n]...)
-
-				// Process complete lines
-				for {
-					lineEnd := -1
-					for i := 0; i < len(accumulated)-1; i++ {
-						if accumulated[i] == '\n' && accumulated[i+1] == '\n' {
-							lineEnd = i + 2
-							break
-						}
-					}
-
-					if lineEnd == -1 {
-						break
-					}
-
-					line := accumulated[:lineEnd-2] // Remove \n\n
-					accumulated = accumulated[lineEnd:]
-
-					if len(line) > 0 {
-						select {
-						case linesChan <- line:
-						case <-ctx.Done():
-							errChan <- ctx.Err()
-							return
-						}
-					}
+			if !scanner.Scan() {
+				if idleTimedOut.Load() {
+					errChan <- ErrStreamIdleTimeout
+				} else if ctx.Err() != nil {
+					errChan <- ctx.Err()
+				} else if err := scanner.Err(); err != nil {
+					errChan <- err
 				}
+				return
 			}
 
-			if err != nil {
-				if err.Error() != "EOF" {
-					errChan <- err
-				}
+			if len(scanner.Bytes()) == 0 {
+				continue
+			}
+
+			// The scanner reuses its buffer, so hand out a copy
+			line := append([]byte(nil), scanner.Bytes()...)
+			select {
+			case linesChan <- line:
+			case <-ctx.Done():
+				errChan <- ctx.Err()
 				return
 			}
 		}
@@ -165,6 +415,17 @@ func (sr *StreamResponse) ConvertToOpenAIStream(ctx context.Context) (<-chan []b
 		defer close(outputChan)
 		defer close(errChan)
 
+		lastID := generateChatCompletionID()
+		upstreamModel := "" // Latest model the gateway reported, for system_fingerprint
+
+		// A chunk whose JSON was cut across SSE frames is buffered here until
+		// the following frames complete it
+		var pending string
+		var pendingFrames int
+
+		// Strips or redirects tagged reasoning blocks, if configured
+		tagFilter := newReasoningTagFilter()
+
 		for {
 			select {
 			case <-ctx.Done():
@@ -177,6 +438,61 @@ func (sr *StreamResponse) ConvertToOpenAIStream(ctx context.Context) (<-chan []b
 				}
 			case line, ok := <-linesChan:
 				if !ok {
+					// The reader closes its error channel first, so an error it
+					// stopped on is already waiting; don't end the stream cleanly
+					if err := <-inputErrChan; err != nil {
+						errChan <- err
+						return
+					}
+
+					// Release text the tag filter held back waiting for a possible tag
+					if tagFilter != nil {
+						if content, reasoning := tagFilter.apply("", true); content != "" || reasoning != "" {
+							restChunk, err := json.Marshal(ChatCompletionStreamResponse{
+								ID:      lastID,
+								Object:  "chat.completion.chunk",
+								Created: time.Now().Unix(),
+								Model:   responseModelName(sr.Model),
+								Choices: []ChatCompletionChoice{{
+									Delta: &ChatMessage{Content: content, ReasoningContent: reasoning},
+								}},
+
+								SystemFingerprint: systemFingerprint(sr.Model, upstreamModel),
+							})
+							if err == nil {
+								select {
+								case outputChan <- []byte(fmt.Sprintf("data: %s\n\n", restChunk)):
+								case <-ctx.Done():
+									errChan <- ctx.Err()
+									return
+								}
+							}
+						}
+					}
+
+					// Send the usage chunk, if requested, before [DONE]
+					if sr.IncludeUsage {
+						usage := sr.Usage()
+						usageChunk, err := json.Marshal(ChatCompletionStreamResponse{
+							ID:      lastID,
+							Object:  "chat.completion.chunk",
+							Created: time.Now().Unix(),
+							Model:   responseModelName(sr.Model),
+							Choices: []ChatCompletionChoice{},
+							Usage:   &usage,
+
+							SystemFingerprint: systemFingerprint(sr.Model, upstreamModel),
+						})
+						if err == nil {
+							select {
+							case outputChan <- []byte(fmt.Sprintf("data: %s\n\n", usageChunk)):
+							case <-ctx.Done():
+								errChan <- ctx.Err()
+								return
+							}
+						}
+					}
+
 					// Send final [DONE] message
 					select {
 					case outputChan <- []byte("data: [DONE]\n\n"):
@@ -191,22 +507,57 @@ func (sr *StreamResponse) ConvertToOpenAIStream(ctx context.Context) (<-chan []b
 					continue
 				}
 
-				data := trim(lineStr[5:])
-				if data == "[DONE]" {
+				if trim(lineStr[5:]) == "[DONE]" {
 					continue
 				}
 
-				// Parse Atlassian chunk
+				// Only the single space after "data:" is framing; whitespace at
+				// the edges of a partial frame may belong to a split JSON string
+				data := strings.TrimPrefix(lineStr[5:], " ")
+
+				// Parse Atlassian chunk, reassembling it with any buffered partial frame
 				var atlasChunk AtlassianStreamChunk
-				if err := json.Unmarshal([]byte(data), &atlasChunk); err != nil {
-					if DebugMode {
-						log.Printf("Unable to decode JSON from upstream: %s", data[:min(len(data), 100)])
+				if pending != "" {
+					combined := pending + data
+					if err := json.Unmarshal([]byte(combined), &atlasChunk); err == nil {
+						pending, pendingFrames = "", 0
+					} else if err := json.Unmarshal([]byte(data), &atlasChunk); err == nil {
+						if DebugMode {
+							log.Printf("Discarding incomplete JSON from upstream: %s", pending[:min(len(pending), 100)])
+						}
+						pending, pendingFrames = "", 0
+					} else {
+						pendingFrames++
+						if pendingFrames >= MaxPartialChunkFrames {
+							if DebugMode {
+								log.Printf("Unable to decode JSON from upstream: %s", combined[:min(len(combined), 100)])
+							}
+							pending, pendingFrames = "", 0
+						} else {
+							pending = combined
+						}
+						continue
 					}
+				} else if err := json.Unmarshal([]byte(data), &atlasChunk); err != nil {
+					pending, pendingFrames = data, 1
 					continue
 				}
 
-				// Convert to OpenAI format
+				// Keep the latest usage metrics the upstream reported
+				if atlasChunk.Metrics != nil {
+					sr.usageMu.Lock()
+					sr.usage = atlasChunk.Metrics.Usage
+					sr.usageMu.Unlock()
+				}
+
+				// Convert to OpenAI format, keeping the fingerprint the same on every
+				// chunk even when only some of them name the upstream model
+				if atlasChunk.PlatformAttributes.Model != "" {
+					upstreamModel = atlasChunk.PlatformAttributes.Model
+				}
 				openChunk := ToOpenAIStreamChunk(atlasChunk, sr.Model)
+				openChunk.SystemFingerprint = systemFingerprint(sr.Model, upstreamModel)
+				lastID = openChunk.ID
 
 				// Skip empty chunks
 				if len(openChunk.Choices) == 0 {
@@ -214,7 +565,13 @@ func (sr *StreamResponse) ConvertToOpenAIStream(ctx context.Context) (<-chan []b
 				}
 
 				choice := openChunk.Choices[0]
-				if choice.Delta == nil || (choice.Delta.Role == "" && choice.Delta.Content == "" && choice.FinishReason == nil) {
+				if tagFilter != nil && choice.Delta != nil {
+					text, _ := choice.Delta.Content.(string)
+					content, reasoning := tagFilter.apply(text, false)
+					choice.Delta.Content = content
+					choice.Delta.ReasoningContent += reasoning
+				}
+				if choice.Delta == nil || (choice.Delta.Role == "" && choice.Delta.Content == "" && choice.Delta.ReasoningContent == "" && len(choice.Delta.ToolCalls) == 0 && choice.FinishReason == nil) {
 					continue
 				}
 
@@ -238,6 +595,70 @@ func (sr *StreamResponse) ConvertToOpenAIStream(ctx context.Context) (<-chan []b
 	return outputChan, errChan
 }
 
+// splitSSEFrames returns a bufio.SplitFunc yielding frames separated by a blank
+// line ("\n\n"), without the separator. It remembers how far the pending frame
+// has been searched so bytes aren't re-scanned as more data arrives. An
+// incomplete trailing frame at EOF is discarded.
+func splitSSEFrames() bufio.SplitFunc {
+	searched := 0
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		// Back up one byte in case the separator straddles two reads
+		start := max(searched-1, 0)
+		if i := bytes.Index(data[start:], sseFrameSeparator); i >= 0 {
+			end := start + i
+			searched = 0
+			return end + len(sseFrameSeparator), data[:end], nil
+		}
+		if atEOF {
+			searched = 0
+			return len(data), nil, nil
+		}
+		searched = len(data)
+		return 0, nil, nil
+	}
+}
+
+var sseFrameSeparator = []byte("\n\n")
+
+// activityReader calls onRead whenever the underlying reader returns data
+type activityReader struct {
+	r      io.Reader
+	onRead func()
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.onRead()
+	}
+	return n, err
+}
+
+// decodedBody returns the raw response body, wrapped in a decompressor when the
+// upstream sent a compressed stream (resty doesn't decode unparsed responses)
+func decodedBody(resp *resty.Response) (io.Reader, error) {
+	switch strings.ToLower(resp.Header().Get("Content-Encoding")) {
+	case "gzip":
+		return gzip.NewReader(resp.RawBody())
+	case "deflate":
+		return deflateReader(resp.RawBody())
+	default:
+		return resp.RawBody(), nil
+	}
+}
+
+// deflateReader decodes an HTTP deflate body, which is zlib-wrapped (RFC 9110
+// §8.4.1.2). Some servers send raw DEFLATE instead, so a body without a valid
+// zlib header is read as that.
+func deflateReader(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+	header, err := br.Peek(2)
+	if err == nil && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
 func hasPrefix(s, prefix string) bool {
 	return len(s) >= len(prefix) && s[:len(prefix)] == prefix
 }
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestStreamLinesTimeouts(t *testing.T) {
+	frame := sseFrame("", textElement("x"))
+	tests := []struct {
+		name      string
+		firstByte time.Duration
+		idle      time.Duration
+		frames    []string
+		gap       time.Duration
+		wantLines int
+		wantErr   error
+	}{
+		{"no first byte", 30 * time.Millisecond, time.Minute, []string{"", frame}, 200 * time.Millisecond, 0, ErrStreamIdleTimeout},
+		{"goes quiet mid-stream", time.Minute, 30 * time.Millisecond, []string{frame, frame}, 200 * time.Millisecond, 1, ErrStreamIdleTimeout},
+		{"steady stream", time.Minute, 150 * time.Millisecond, []string{frame, frame, frame}, 20 * time.Millisecond, 3, nil},
+		{"zero disables both", 0, 0, []string{"", frame, frame}, 50 * time.Millisecond, 2, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &StreamFirstByteTimeout, tt.firstByte)
+			setValue(t, &StreamIdleTimeout, tt.idle)
+			useCredentials(t, testCredentials(1)...)
+			sr := openStream(t, delayedStream(tt.gap, tt.frames...))
+
+			lines, err := drainStream(sr.StreamLines(context.Background()))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+			if len(lines) != tt.wantLines {
+				t.Errorf("got %d lines, want %d", len(lines), tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestJitteredDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		delay    time.Duration
+		min, max time.Duration
+	}{
+		{"initial delay", InitialDelay, InitialDelay / 2, InitialDelay},
+		{"capped at MaxDelay", 10 * MaxDelay, MaxDelay / 2, MaxDelay},
+		{"too small to jitter", time.Nanosecond, time.Nanosecond, time.Nanosecond},
+		{"zero", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for range 200 {
+				got := jitteredDelay(tt.delay)
+				if got < tt.min || got > tt.max {
+					t.Fatalf("jitteredDelay(%v) = %v, want within [%v, %v]", tt.delay, got, tt.min, tt.max)
+				}
+				seen[got] = true
+			}
+			if tt.min != tt.max && len(seen) < 2 {
+				t.Errorf("jitteredDelay(%v) never varied", tt.delay)
+			}
+		})
+	}
+}
+
+func TestFetchWithRetryAttempts(t *testing.T) {
+	tests := []struct {
+		name       string
+		creds      int
+		maxRetries int
+		want       []string
+	}{
+		{"one attempt", 1, 1, []string{"c0@example.com"}},
+		{"retries a single credential", 1, 2, []string{"c0@example.com", "c0@example.com"}},
+		{"default minimum", 1, 0, []string{"c0@example.com", "c0@example.com", "c0@example.com"}},
+		{"fewer attempts than credentials", 2, 1, []string{"c0@example.com"}},
+		{"rotates past the last credential", 2, 3, []string{"c0@example.com", "c1@example.com", "c0@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &MaxRetries, tt.maxRetries)
+			setValue(t, &CredentialStrategy, "priority")
+			useCredentials(t, testCredentials(tt.creds)...)
+			var mu sync.Mutex
+			var got []string
+			client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				mu.Lock()
+				got = append(got, requestEmail(r))
+				mu.Unlock()
+				return jsonResponse(http.StatusServiceUnavailable, `{}`), nil
+			})
+
+			_, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false)
+
+			if !errors.Is(err, ErrUpstreamUnavailable) {
+				t.Errorf("error = %v, want ErrUpstreamUnavailable", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("attempts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamProxy(t *testing.T) {
+	tests := []struct {
+		name     string
+		userinfo string
+		wantAuth string
+	}{
+		{"anonymous proxy", "", ""},
+		{"proxy credentials", "user:pass@", "Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connects := make(chan *http.Request, 10)
+			proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				connects <- r
+				http.Error(w, "refused", http.StatusForbidden)
+			}))
+			defer proxy.Close()
+			setValue(t, &UpstreamProxy, strings.Replace(proxy.URL, "http://", "http://"+tt.userinfo, 1))
+			setValue(t, &MaxRetries, 1)
+			useCredentials(t, testCredentials(1)...)
+
+			_, err := NewHTTPClient().FetchWithRetry(context.Background(), upstreamRequest(), false)
+			if err == nil {
+				t.Fatal("request succeeded through a refusing proxy")
+			}
+
+			select {
+			case r := <-connects:
+				if r.Method != http.MethodConnect || r.Host != "api.atlassian.com:443" {
+					t.Errorf("proxy got %s %s, want CONNECT api.atlassian.com:443", r.Method, r.Host)
+				}
+				if got := r.Header.Get("Proxy-Authorization"); got != tt.wantAuth {
+					t.Errorf("Proxy-Authorization = %q, want %q", got, tt.wantAuth)
+				}
+			default:
+				t.Fatal("upstream request bypassed the proxy")
+			}
+		})
+	}
+}
+
+func TestStartCredentialIndex(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		weights  []int
+		want     []int
+	}{
+		{"round robin continues across requests", "roundrobin", []int{1, 1, 1}, []int{0, 1, 2, 0, 1}},
+		{"priority", "priority", []int{1, 1, 1}, []int{0, 0, 0}},
+		{"weighted skips zero weights", "weighted", []int{0, 1, 0}, []int{1, 1, 1}},
+		{"weighted falls back to round robin", "weighted", []int{0, 0}, []int{0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &CredentialStrategy, tt.strategy)
+			creds := testCredentials(len(tt.weights))
+			for i, w := range tt.weights {
+				creds[i].Weight = w
+			}
+			useCredentials(t, creds...)
+
+			var got []int
+			for range tt.want {
+				got = append(got, startCredentialIndex(creds))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("start indexes = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchWithRetryRotatesAcrossRequests(t *testing.T) {
+	setValue(t, &CredentialStrategy, "roundrobin")
+	useCredentials(t, testCredentials(2)...)
+	var got []string
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		got = append(got, requestEmail(r))
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("hi"))), nil
+	})
+
+	for range 3 {
+		// Each request starts one credential past the previous one
+		if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"c0@example.com", "c1@example.com", "c0@example.com"}; !slices.Equal(got, want) {
+		t.Errorf("credentials used = %v, want %v", got, want)
+	}
+}
+
+func TestStreamLinesContentEncoding(t *testing.T) {
+	frames := sseFrame("", textElement("a")) + sseFrame("end_turn", textElement("b"))
+	gzipped := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	deflated := func(s string) []byte {
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	rawDeflated := func(s string) []byte {
+		var buf bytes.Buffer
+		zw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{"identity", "", []byte(frames)},
+		{"gzip", "gzip", gzipped(frames)},
+		{"upper case", "GZIP", gzipped(frames)},
+		{"deflate", "deflate", deflated(frames)},
+		{"raw deflate", "deflate", rawDeflated(frames)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			sr := openStream(t, func(*http.Request) (*http.Response, error) {
+				resp := sseResponse(io.NopCloser(bytes.NewReader(tt.body)))
+				if tt.encoding != "" {
+					resp.Header.Set("Content-Encoding", tt.encoding)
+				}
+				return resp, nil
+			})
+
+			lines, err := drainStream(sr.StreamLines(context.Background()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Split(strings.TrimSpace(frames), "\n\n"); !slices.Equal(lines, want) {
+				t.Errorf("lines = %q, want %q", lines, want)
+			}
+		})
+	}
+}
+
+func TestSplitSSEFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"single frame", "data: a\n\n", []string{"data: a"}},
+		{"several frames", "data: a\n\ndata: b\n\n", []string{"data: a", "data: b"}},
+		{"multi-line frame", "event: x\ndata: a\n\n", []string{"event: x\ndata: a"}},
+		{"incomplete tail is dropped", "data: a\n\ndata: b", []string{"data: a"}},
+		{"blank frames", "\n\n\n\ndata: a\n\n", []string{"", "", "data: a"}},
+	}
+	readers := map[string]func(io.Reader) io.Reader{
+		"whole":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+	}
+	for _, tt := range tests {
+		for readerName, wrap := range readers {
+			t.Run(tt.name+"/"+readerName, func(t *testing.T) {
+				scanner := bufio.NewScanner(wrap(strings.NewReader(tt.input)))
+				scanner.Split(splitSSEFrames())
+				var got []string
+				for scanner.Scan() {
+					got = append(got, scanner.Text())
+				}
+				if err := scanner.Err(); err != nil {
+					t.Fatal(err)
+				}
+				if !slices.Equal(got, tt.want) {
+					t.Errorf("frames = %q, want %q", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestStreamLinesFrameSizeLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantErr error
+	}{
+		{"within the limit", 100, nil},
+		{"over the limit", 5000, bufio.ErrTooLong},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &MaxSSEFrameSize, 4096)
+			useCredentials(t, testCredentials(1)...)
+			sr := openStream(t, func(*http.Request) (*http.Response, error) {
+				body := "data: " + strings.Repeat("x", tt.size) + "\n\n"
+				return sseResponse(io.NopCloser(strings.NewReader(body))), nil
+			})
+
+			_, err := drainStream(sr.StreamLines(context.Background()))
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func BenchmarkStreamLines(b *testing.B) {
+	body := strings.Repeat(sseFrame("", textElement("token ")), 1000)
+	old := Credentials
+	Credentials = testCredentials(1)
+	b.Cleanup(func() {
+		Credentials = old
+		resetCredentialState()
+	})
+	client := NewHTTPClient()
+	client.client.SetTransport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		return sseResponse(io.NopCloser(strings.NewReader(body))), nil
+	}))
+	b.ReportAllocs()
+	for b.Loop() {
+		resp, err := client.FetchWithRetry(context.Background(), upstreamRequest(), true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sr := &StreamResponse{Response: resp, Model: testModel}
+		drainStream(sr.StreamLines(context.Background()))
+	}
+}
+
+// splitFrame cuts the JSON of a stream frame into parts sent as separate SSE frames
+func splitFrame(frame string, parts int) string {
+	data := strings.TrimSuffix(strings.TrimPrefix(frame, "data: "), "\n\n")
+	size := len(data)/parts + 1
+	var out strings.Builder
+	for len(data) > 0 {
+		n := min(size, len(data))
+		out.WriteString("data: " + data[:n] + "\n\n")
+		data = data[n:]
+	}
+	return out.String()
+}
+
+func TestConvertPartialChunks(t *testing.T) {
+	hello := sseFrame("", textElement("Hello"))
+	world := sseFrame("", textElement(" world"))
+	end := sseFrame("end_turn")
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"whole frames", hello + world + end, "Hello world"},
+		{"split across two frames", splitFrame(hello, 2) + world + end, "Hello world"},
+		{"split across three frames", hello + splitFrame(world, 3) + end, "Hello world"},
+		{"garbage dropped when the next frame parses", "data: {\"response_payload\":\n\n" + hello + world + end, "Hello world"},
+		{"given up after the frame limit", "data: {\"a\":\n\ndata: [1,\n\ndata: 2,\n\n" + hello + world + end, "Hello world"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			sr := openStream(t, func(*http.Request) (*http.Response, error) {
+				return sseResponse(io.NopCloser(strings.NewReader(tt.body))), nil
+			})
+
+			lines, err := drainStream(sr.ConvertToOpenAIStream(context.Background()))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			var content strings.Builder
+			for _, line := range lines {
+				for _, chunk := range streamChunks(t, line) {
+					for _, choice := range chunk.Choices {
+						if choice.Delta != nil {
+							text, _ := choice.Delta.Content.(string)
+							content.WriteString(text)
+						}
+					}
+				}
+			}
+			if content.String() != tt.want {
+				t.Errorf("content = %q, want %q", content.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name      string
+		idleConns int
+		wantConns int32
+	}{
+		{"kept alive across requests", 16, 1},
+		{"idle pool disabled", -1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conns atomic.Int32
+			gateway := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, upstreamCompletion(textElement("ok")))
+			}))
+			gateway.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			gateway.StartTLS()
+			defer gateway.Close()
+			setValue(t, &UpstreamProxy, "")
+			setValue(t, &UpstreamMaxIdleConnsPerHost, tt.idleConns)
+			useCredentials(t, testCredentials(1)...)
+
+			// Point the client's own pooled transport at the test gateway
+			client := NewHTTPClient()
+			transport := client.client.GetClient().Transport.(*http.Transport)
+			transport.Proxy = nil
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, gateway.Listener.Addr().String())
+			}
+
+			for range 3 {
+				if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if got := conns.Load(); got != tt.wantConns {
+				t.Errorf("gateway saw %d connections, want %d", got, tt.wantConns)
+			}
+		})
+	}
+}
+
+func TestSharedHTTPClient(t *testing.T) {
+	if SharedHTTPClient() != SharedHTTPClient() {
+		t.Error("SharedHTTPClient returned different clients")
+	}
+}
+
+func TestWeightedCredentialDistribution(t *testing.T) {
+	creds := testCredentials(4)
+	for i, w := range []int{1, 3, 0, 6} {
+		creds[i].Weight = w
+	}
+	const draws = 20000
+	counts := make([]int, len(creds))
+	for range draws {
+		idx, ok := weightedCredentialIndex(creds)
+		if !ok {
+			t.Fatal("no credential picked")
+		}
+		counts[idx]++
+	}
+
+	if counts[2] != 0 {
+		t.Errorf("zero-weight credential picked %d times", counts[2])
+	}
+	for i, share := range []float64{0.1, 0.3, 0, 0.6} {
+		if got := float64(counts[i]) / draws; got < share-0.02 || got > share+0.02 {
+			t.Errorf("credential %d picked %.3f of the time, want about %.1f", i, got, share)
+		}
+	}
+}
+
+func TestWeightedSelectionSkipsUnhealthy(t *testing.T) {
+	setValue(t, &CredentialStrategy, "weighted")
+	creds := testCredentials(2)
+	creds[0].Weight = 100
+	useCredentials(t, creds...)
+	setCredentialHealth("c0@example.com", false)
+	var used []string
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		used = append(used, requestEmail(r))
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	for range 20 {
+		if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if slices.Contains(used, "c0@example.com") {
+		t.Errorf("unhealthy credential used: %v", used)
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name         string
+		budget       time.Duration
+		ctxTimeout   time.Duration
+		wantErr      string
+		wantDeadline bool
+	}{
+		// Backoff starts at InitialDelay (500ms), so the second retry no longer fits
+		{"budget stops retries", 600 * time.Millisecond, 0, "retry budget spent", false},
+		{"context deadline stops retries", 0, 600 * time.Millisecond, "no time left to retry", true},
+		{"tighter of the two applies", time.Minute, 600 * time.Millisecond, "no time left to retry", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &RetryBudget, tt.budget)
+			useCredentials(t, testCredentials(5)...)
+			var attempts atomic.Int32
+			client := useUpstream(t, func(*http.Request) (*http.Response, error) {
+				attempts.Add(1)
+				return jsonResponse(http.StatusServiceUnavailable, `{}`), nil
+			})
+			ctx := context.Background()
+			if tt.ctxTimeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.ctxTimeout)
+				defer cancel()
+			}
+			start := time.Now()
+
+			_, err := client.FetchWithRetry(ctx, upstreamRequest(), false)
+
+			if elapsed := time.Since(start); elapsed > 600*time.Millisecond {
+				t.Errorf("returned after %v, want within 600ms", elapsed)
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+			if got := errors.Is(err, context.DeadlineExceeded); got != tt.wantDeadline {
+				t.Errorf("deadline exceeded = %v, want %v", got, tt.wantDeadline)
+			}
+			if n := attempts.Load(); n >= 5 {
+				t.Errorf("%d attempts, want the budget to cut retries short", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// upstreamSlots limits the number of in-flight upstream requests.
+// A nil channel means no limit is configured.
+var upstreamSlots = newUpstreamSlots(MaxConcurrentRequests)
+
+func newUpstreamSlots(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
+
+// AcquireUpstreamSlot waits for a free upstream slot, giving up after
+// ConcurrencyWaitTimeout or when ctx is cancelled. The returned release
+// function must be called once the request (including any stream) is done.
+func AcquireUpstreamSlot(ctx context.Context) (release func(), ok bool) {
+	if upstreamSlots == nil {
+		return func() {}, true
+	}
+
+	timer := time.NewTimer(ConcurrencyWaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case upstreamSlots <- struct{}{}:
+		return func() { <-upstreamSlots }, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
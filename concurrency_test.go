@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestAcquireUpstreamSlot(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		held     int
+		canceled bool
+		wantOK   bool
+	}{
+		{"unlimited", 0, 0, false, true},
+		{"free slot", 2, 1, false, true},
+		{"all slots held", 1, 1, false, false},
+		{"caller gone", 1, 1, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &upstreamSlots, newUpstreamSlots(tt.limit))
+			setValue(t, &ConcurrencyWaitTimeout, 20*time.Millisecond)
+			for range tt.held {
+				upstreamSlots <- struct{}{}
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.canceled {
+				cancel()
+			}
+			defer cancel()
+
+			release, ok := AcquireUpstreamSlot(ctx)
+			if ok != tt.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if tt.limit > 0 && len(upstreamSlots) != tt.held+1 {
+				t.Errorf("slots in use = %d, want %d", len(upstreamSlots), tt.held+1)
+			}
+			release()
+			if tt.limit > 0 && len(upstreamSlots) != tt.held {
+				t.Errorf("slots in use after release = %d, want %d", len(upstreamSlots), tt.held)
+			}
+		})
+	}
+}
+
+func TestChatCompletionsConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		name           string
+		wait           time.Duration
+		wantRetryAfter string
+	}{
+		{"sub-second wait rounds up", 10 * time.Millisecond, "1"},
+		{"whole seconds", 2 * time.Second, "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &upstreamSlots, newUpstreamSlots(1))
+			setValue(t, &ConcurrencyWaitTimeout, tt.wait)
+			upstreamSlots <- struct{}{}
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				t.Error("upstream called while every slot is held")
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("hi"))), nil
+			})
+
+			w := postChat(t, chatBody(""), nil)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503", w.Code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"atlassian/db"
+)
+
+func TestEnvDuration(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"unset", "", time.Minute},
+		{"valid", "90s", 90 * time.Second},
+		{"zero disables", "0", 0},
+		{"negative is rejected", "-5s", time.Minute},
+		{"malformed is rejected", "soon", time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_DURATION", tt.value)
+			if got := envDuration("TEST_DURATION", time.Minute); got != tt.want {
+				t.Errorf("envDuration(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCredentialsForModel(t *testing.T) {
+	creds := []Credential{
+		{Email: "any@example.com"},
+		{Email: "sonnet4@example.com", Models: []string{"claude-sonnet-4@20250514"}},
+		{Email: "prefixed@example.com", Models: []string{"anthropic:claude-3-7-sonnet@20250219"}},
+	}
+	tests := []struct {
+		model string
+		want  []string
+	}{
+		{"anthropic:claude-sonnet-4@20250514", []string{"any@example.com", "sonnet4@example.com"}},
+		{"claude-sonnet-4@20250514", []string{"any@example.com", "sonnet4@example.com"}},
+		{"claude-3-7-sonnet@20250219", []string{"any@example.com", "prefixed@example.com"}},
+		{"anthropic:claude-3-5-sonnet-v2@20241022", []string{"any@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			setValue(t, &Credentials, creds)
+			var got []string
+			for _, cred := range CredentialsForModel(tt.model) {
+				got = append(got, cred.Email)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("CredentialsForModel(%q) = %v, want %v", tt.model, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchWithRetryModelCredentials(t *testing.T) {
+	tests := []struct {
+		name      string
+		models    [][]string
+		wantEmail string
+		wantErr   bool
+	}{
+		{"skips credentials for other models", [][]string{{"claude-3-7-sonnet@20250219"}, {"claude-sonnet-4@20250514"}}, "c1@example.com", false},
+		{"unrestricted credential", [][]string{{"claude-3-7-sonnet@20250219"}, nil}, "c1@example.com", false},
+		{"no eligible credential", [][]string{{"claude-3-7-sonnet@20250219"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			creds := testCredentials(len(tt.models))
+			for i, models := range tt.models {
+				creds[i].Models = models
+			}
+			setValue(t, &CredentialStrategy, "priority")
+			useCredentials(t, creds...)
+			var got string
+			client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				got = requestEmail(r)
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("hi"))), nil
+			})
+
+			_, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false)
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.wantEmail {
+				t.Errorf("used %q, want %q", got, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestLoadCredentialsKeepsPreviousOnFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		dbDown    bool
+		wantEmail string
+	}{
+		{"database available", false, "stored@example.com"},
+		{"database unavailable", true, "previous@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearCredentials(t)
+			t.Cleanup(func() { clearCredentials(t) })
+			if err := db.AddCredential("stored@example.com", "t", "", 0, nil); err != nil {
+				t.Fatal(err)
+			}
+			setValue(t, &Credentials, []Credential{{Email: "previous@example.com", Token: "t"}})
+			if tt.dbDown {
+				// A missing table makes the query fail like an outage would
+				migrator := db.GetDB().Migrator()
+				if err := migrator.RenameTable("credentials", "credentials_offline"); err != nil {
+					t.Fatal(err)
+				}
+				defer migrator.RenameTable("credentials_offline", "credentials")
+			}
+
+			LoadCredentials()
+
+			if len(Credentials) != 1 || Credentials[0].Email != tt.wantEmail {
+				t.Errorf("credentials = %+v, want only %s", Credentials, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestValidateDefaultModel(t *testing.T) {
+	tests := []struct {
+		model   string
+		wantErr bool
+	}{
+		{"", false},
+		{testModel, false},
+		{"claude-sonnet-4@20250514", false},
+		{"anthropic:no-such-model", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.model, func(t *testing.T) {
+			setValue(t, &DefaultModel, tt.model)
+			if err := ValidateDefaultModel(); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateDefaultModel() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseModelOwners(t *testing.T) {
+	got := parseModelOwners(" anthropic:claude-sonnet-4@20250514 = acme ,bad-entry, =nobody,plain=")
+	want := map[string]string{"claude-sonnet-4@20250514": "acme"}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseModelOwners() = %v, want %v", got, want)
+	}
+}
+
+func TestLoadStaticCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials.json")
+	if err := os.WriteFile(file, []byte(`[{"email":"file@example.com","token":"t"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		envJSON   string
+		file      string
+		wantEmail []string
+	}{
+		{"no static source", "", "", []string{"db@example.com", "shared@example.com"}},
+		{"env source merged ahead of the database", `[{"email":"env@example.com","token":"t","models":["claude-sonnet-4@20250514"]}]`, "", []string{"env@example.com", "db@example.com", "shared@example.com"}},
+		{"file source", "", file, []string{"file@example.com", "db@example.com", "shared@example.com"}},
+		{"env wins over the file", `[{"email":"env@example.com","token":"t"}]`, file, []string{"env@example.com", "db@example.com", "shared@example.com"}},
+		{"de-duplicated by email", `[{"email":"shared@example.com","token":"static"},{"email":"shared@example.com","token":"again"}]`, "", []string{"shared@example.com", "db@example.com"}},
+		{"invalid JSON ignored", `{"email":"env@example.com"}`, "", []string{"db@example.com", "shared@example.com"}},
+		{"missing token ignored", `[{"email":"env@example.com"}]`, "", []string{"db@example.com", "shared@example.com"}},
+		{"missing file ignored", "", filepath.Join(t.TempDir(), "missing.json"), []string{"db@example.com", "shared@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CREDENTIALS_JSON", tt.envJSON)
+			t.Setenv("CREDENTIALS_FILE", tt.file)
+			setValue(t, &Credentials, nil)
+			clearCredentials(t)
+			t.Cleanup(func() { clearCredentials(t) })
+			for _, email := range []string{"db@example.com", "shared@example.com"} {
+				if err := db.AddCredential(email, "db-token", "", 0, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			LoadCredentials()
+
+			var got []string
+			for _, cred := range Credentials {
+				got = append(got, cred.Email)
+				if static := cred.Token != "db-token"; cred.ReadOnly != static {
+					t.Errorf("%s read-only = %v, want %v", cred.Email, cred.ReadOnly, static)
+				}
+			}
+			if !slices.Equal(got, tt.wantEmail) {
+				t.Errorf("credentials = %v, want %v", got, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestValidateCredentialStrategy(t *testing.T) {
+	for _, strategy := range []string{"roundrobin", "priority", "weighted", "random"} {
+		t.Run(strategy, func(t *testing.T) {
+			setValue(t, &CredentialStrategy, strategy)
+			if err := ValidateCredentialStrategy(); (err != nil) != (strategy == "random") {
+				t.Errorf("ValidateCredentialStrategy() = %v", err)
+			}
+		})
+	}
+}
+
+func TestParseResponseModelNames(t *testing.T) {
+	got := parseResponseModelNames("anthropic:claude-sonnet-4@20250514=my-assistant, claude-3-7-sonnet@20250219 = other ,junk,=x")
+	want := map[string]string{"claude-sonnet-4@20250514": "my-assistant", "claude-3-7-sonnet@20250219": "other"}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseResponseModelNames() = %v, want %v", got, want)
+	}
+}
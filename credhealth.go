@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// StartCredentialHealthChecks probes every credential against the gateway each
+// CredentialHealthCheckInterval until ctx is cancelled. An interval of 0 disables it.
+func StartCredentialHealthChecks(ctx context.Context) {
+	if CredentialHealthCheckInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(CredentialHealthCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if len(loadedCredentials()) > 0 && len(SupportedModels) > 0 {
+					checkCredentialHealth(ctx)
+				}
+			}
+		}
+	}()
+}
+
+// checkCredentialHealth probes each loaded credential once and updates its health.
+// Only auth failures mark a credential unhealthy; network errors and 5xx say
+// nothing about the credential itself and leave its state unchanged.
+func checkCredentialHealth(ctx context.Context) {
+	for _, cred := range loadedCredentials() {
+		if ctx.Err() != nil {
+			return
+		}
+
+		probeCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		status, err := probeCredential(probeCtx, cred)
+		cancel()
+
+		switch {
+		case err != nil || status >= 500:
+			if DebugMode {
+				log.Printf("Health check for %s inconclusive (status %d): %v", cred.Email, status, err)
+			}
+		case status == 401 || status == 403:
+			if setCredentialHealth(cred.Email, false) {
+				log.Printf("Credential %s failed its health check (status %d), removed from rotation", cred.Email, status)
+			}
+		default:
+			if setCredentialHealth(cred.Email, true) {
+				log.Printf("Credential %s recovered, returned to rotation", cred.Email)
+			}
+		}
+	}
+}
+
+// preferHealthy drops credentials marked unhealthy or whose rate-limit quota
+// hasn't reset yet, unless that would leave none
+func preferHealthy(credentials []Credential) []Credential {
+	now := time.Now()
+	healthy := make([]Credential, 0, len(credentials))
+	for _, cred := range credentials {
+		stats := getCredentialStats(cred.Email)
+		if !stats.Unhealthy && !stats.rateLimited(now) {
+			healthy = append(healthy, cred)
+		}
+	}
+	if len(healthy) == 0 {
+		return credentials
+	}
+	return healthy
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckCredentialHealth(t *testing.T) {
+	tests := []struct {
+		name          string
+		wasUnhealthy  bool
+		status        int
+		wantUnhealthy bool
+	}{
+		{"auth failure marks unhealthy", false, http.StatusUnauthorized, true},
+		{"forbidden marks unhealthy", false, http.StatusForbidden, true},
+		{"success brings it back", true, http.StatusOK, false},
+		{"server error leaves healthy", false, http.StatusBadGateway, false},
+		{"server error leaves unhealthy", true, http.StatusBadGateway, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			setCredentialHealth("c0@example.com", !tt.wasUnhealthy)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return jsonResponse(tt.status, `{}`), nil
+			})
+
+			checkCredentialHealth(context.Background())
+
+			if got := getCredentialStats("c0@example.com").Unhealthy; got != tt.wantUnhealthy {
+				t.Errorf("unhealthy = %v, want %v", got, tt.wantUnhealthy)
+			}
+		})
+	}
+}
+
+func TestUnhealthyCredentialSkipped(t *testing.T) {
+	setValue(t, &CredentialStrategy, "priority")
+	useCredentials(t, testCredentials(2)...)
+	var healthy atomic.Bool
+	var used string
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		used = requestEmail(r)
+		if used == "c0@example.com" && !healthy.Load() {
+			return jsonResponse(http.StatusUnauthorized, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	checkCredentialHealth(context.Background())
+	if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+		t.Fatal(err)
+	}
+	if used != "c1@example.com" {
+		t.Errorf("used %s while c0 was unhealthy, want c1@example.com", used)
+	}
+
+	healthy.Store(true)
+	checkCredentialHealth(context.Background())
+	if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+		t.Fatal(err)
+	}
+	if used != "c0@example.com" {
+		t.Errorf("used %s after c0 recovered, want c0@example.com", used)
+	}
+}
+
+func TestCredentialHealthLoop(t *testing.T) {
+	setValue(t, &CredentialHealthCheckInterval, 10*time.Millisecond)
+	useCredentials(t, testCredentials(1)...)
+	var probes atomic.Int32
+	useUpstream(t, func(*http.Request) (*http.Response, error) {
+		probes.Add(1)
+		return jsonResponse(http.StatusUnauthorized, `{}`), nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	StartCredentialHealthChecks(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !getCredentialStats("c0@example.com").Unhealthy {
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatal("credential never marked unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	time.Sleep(30 * time.Millisecond)
+	stopped := probes.Load()
+	time.Sleep(50 * time.Millisecond)
+	if got := probes.Load(); got != stopped {
+		t.Errorf("%d probes after shutdown, want none", got-stopped)
+	}
+}
+
+func TestCredentialReloadDuringHealthCheck(t *testing.T) {
+	useCredentials(t, testCredentials(2)...)
+	useUpstream(t, func(*http.Request) (*http.Response, error) {
+		return jsonResponse(http.StatusOK, `{}`), nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			LoadCredentials()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 20 {
+			checkCredentialHealth(context.Background())
+			runJanitor()
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"sync"
+	"time"
+)
+
+// ErrCredentialsBusy is returned when every credential is at its concurrency
+// limit and the request can't queue for one, or waited longer than CREDENTIAL_QUEUE_TIMEOUT
+var ErrCredentialsBusy = errors.New("all credentials are busy")
+
+var (
+	credentialInFlightMu sync.Mutex
+	credentialInFlight   = make(map[string]int) // Keyed by credential email
+	credentialQueue      = list.New()           // Waiting *credentialWaiter, oldest first
+)
+
+// credentialWaiter is a request queued for a slot on any of its credentials
+type credentialWaiter struct {
+	credentials []Credential
+	granted     chan string // Receives the email of the slot handed over
+	queued      bool        // Still in credentialQueue; guarded by credentialInFlightMu
+}
+
+// wants reports whether the waiter can use the credential with the given email
+func (w *credentialWaiter) wants(email string) bool {
+	return slices.ContainsFunc(w.credentials, func(c Credential) bool { return c.Email == email })
+}
+
+// concurrencyLimit returns the credential's effective limit; 0 means unlimited
+func (c Credential) concurrencyLimit() int {
+	if c.MaxConcurrency > 0 {
+		return c.MaxConcurrency
+	}
+	return CredentialMaxConcurrency
+}
+
+// tryAcquireCredential reserves a request slot on the credential without
+// blocking. It returns false when the credential is already at its limit.
+func tryAcquireCredential(cred Credential) bool {
+	credentialInFlightMu.Lock()
+	defer credentialInFlightMu.Unlock()
+	return tryAcquireCredentialLocked(cred)
+}
+
+// tryAcquireCredentialLocked is tryAcquireCredential for callers holding credentialInFlightMu
+func tryAcquireCredentialLocked(cred Credential) bool {
+	if limit := cred.concurrencyLimit(); limit > 0 && credentialInFlight[cred.Email] >= limit {
+		return false
+	}
+	credentialInFlight[cred.Email]++
+	return true
+}
+
+// releaseCredential frees a slot reserved by tryAcquireCredential. If a queued
+// request can use the credential, the slot passes straight to the oldest one.
+func releaseCredential(email string) {
+	credentialInFlightMu.Lock()
+	defer credentialInFlightMu.Unlock()
+
+	for e := credentialQueue.Front(); e != nil; e = e.Next() {
+		w := e.Value.(*credentialWaiter)
+		if w.wants(email) {
+			credentialQueue.Remove(e)
+			w.queued = false
+			w.granted <- email
+			return
+		}
+	}
+
+	if credentialInFlight[email] <= 1 {
+		delete(credentialInFlight, email)
+		return
+	}
+	credentialInFlight[email]--
+}
+
+// acquireCredential reserves a slot on the first credential, starting at start,
+// that has one free. Saturated credentials are skipped rather than waited on;
+// only when every credential is saturated does the request join a FIFO queue,
+// bounded by CREDENTIAL_QUEUE_DEPTH and CREDENTIAL_QUEUE_TIMEOUT, until a slot
+// is released to it. A cancelled request leaves the queue.
+func acquireCredential(ctx context.Context, credentials []Credential, start int) (int, error) {
+	credentialInFlightMu.Lock()
+	for i := range credentials {
+		idx := (start + i) % len(credentials)
+		if tryAcquireCredentialLocked(credentials[idx]) {
+			credentialInFlightMu.Unlock()
+			return idx, nil
+		}
+	}
+	if CredentialQueueDepth <= 0 || CredentialQueueTimeout <= 0 || credentialQueue.Len() >= CredentialQueueDepth {
+		credentialInFlightMu.Unlock()
+		return 0, ErrCredentialsBusy
+	}
+	w := &credentialWaiter{credentials: credentials, granted: make(chan string, 1), queued: true}
+	elem := credentialQueue.PushBack(w)
+	credentialInFlightMu.Unlock()
+
+	timer := time.NewTimer(CredentialQueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case email := <-w.granted:
+		return slices.IndexFunc(credentials, func(c Credential) bool { return c.Email == email }), nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timer.C:
+		err = ErrCredentialsBusy
+	}
+
+	// Leave the queue, giving back a slot handed over while giving up
+	credentialInFlightMu.Lock()
+	if w.queued {
+		credentialQueue.Remove(elem)
+		w.queued = false
+		credentialInFlightMu.Unlock()
+		return 0, err
+	}
+	credentialInFlightMu.Unlock()
+	releaseCredential(<-w.granted)
+	return 0, err
+}
+
+// releaseOnClose frees a credential slot once a streamed body is closed
+type releaseOnClose struct {
+	io.ReadCloser
+	email string
+	once  sync.Once
+}
+
+func (r *releaseOnClose) Close() error {
+	err := r.ReadCloser.Close()
+	r.once.Do(func() { releaseCredential(r.email) })
+	return err
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAcquireCredentialSkipsSaturated(t *testing.T) {
+	tests := []struct {
+		name    string
+		limits  []int
+		held    []int
+		start   int
+		wantIdx int
+		wantErr error
+	}{
+		{"unlimited", []int{0, 0}, []int{5, 5}, 0, 0, nil},
+		{"free at start", []int{1, 1}, []int{0, 0}, 1, 1, nil},
+		{"saturated skipped", []int{1, 2}, []int{1, 1}, 0, 1, nil},
+		{"wraps around", []int{2, 1}, []int{1, 1}, 1, 0, nil},
+		{"all saturated", []int{1, 1}, []int{1, 1}, 0, 0, ErrCredentialsBusy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &CredentialQueueDepth, 0)
+			creds := testCredentials(len(tt.limits))
+			for i := range creds {
+				creds[i].MaxConcurrency = tt.limits[i]
+			}
+			useCredentials(t, creds...)
+			for i, n := range tt.held {
+				for range n {
+					credentialInFlight[creds[i].Email]++
+				}
+			}
+
+			idx, err := acquireCredential(context.Background(), creds, tt.start)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && idx != tt.wantIdx {
+				t.Errorf("acquired credential %d, want %d", idx, tt.wantIdx)
+			}
+		})
+	}
+}
+
+func TestCredentialConcurrencyLimit(t *testing.T) {
+	setValue(t, &CredentialMaxConcurrency, 2)
+	setValue(t, &CredentialQueueTimeout, 5*time.Second)
+	creds := testCredentials(2)
+	creds[0].MaxConcurrency = 1
+	useCredentials(t, creds...)
+	limits := map[string]int{"c0@example.com": 1, "c1@example.com": 2}
+	var mu sync.Mutex
+	inFlight := make(map[string]int)
+	peak := make(map[string]int)
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		email := requestEmail(r)
+		mu.Lock()
+		inFlight[email]++
+		peak[email] = max(peak[email], inFlight[email])
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		inFlight[email]--
+		mu.Unlock()
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 12)
+	for range 12 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("request failed: %v", err)
+		}
+	}
+	for email, limit := range limits {
+		if peak[email] > limit {
+			t.Errorf("%s peaked at %d concurrent requests, limit %d", email, peak[email], limit)
+		}
+		if peak[email] == 0 {
+			t.Errorf("%s never used", email)
+		}
+	}
+	credentialInFlightMu.Lock()
+	defer credentialInFlightMu.Unlock()
+	if len(credentialInFlight) != 0 {
+		t.Errorf("slots still held: %v", credentialInFlight)
+	}
+}
+
+// queuedRequests returns how many requests are waiting for a credential slot
+func queuedRequests() int {
+	credentialInFlightMu.Lock()
+	defer credentialInFlightMu.Unlock()
+	return credentialQueue.Len()
+}
+
+func TestCredentialQueueFIFO(t *testing.T) {
+	setValue(t, &CredentialQueueTimeout, 5*time.Second)
+	creds := testCredentials(1)
+	creds[0].MaxConcurrency = 1
+	useCredentials(t, creds...)
+	if _, err := acquireCredential(context.Background(), creds, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	granted := make(chan int, 3)
+	for i := range 3 {
+		go func() {
+			if _, err := acquireCredential(context.Background(), creds, 0); err != nil {
+				t.Error(err)
+			}
+			granted <- i
+		}()
+		// Queue them one at a time so the arrival order is known
+		for queuedRequests() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	var order []int
+	for range 3 {
+		releaseCredential(creds[0].Email)
+		order = append(order, <-granted)
+	}
+	releaseCredential(creds[0].Email)
+
+	if !slices.Equal(order, []int{0, 1, 2}) {
+		t.Errorf("slots granted in order %v, want arrival order", order)
+	}
+}
+
+func TestCredentialQueueLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		depth    int
+		timeout  time.Duration
+		waiting  int
+		cancel   bool
+		wantErr  error
+		minDelay time.Duration
+	}{
+		{"queueing off without depth", 0, time.Second, 0, false, ErrCredentialsBusy, 0},
+		{"queueing off without timeout", 10, 0, 0, false, ErrCredentialsBusy, 0},
+		{"queue full", 1, time.Second, 1, false, ErrCredentialsBusy, 0},
+		{"waited too long", 10, 30 * time.Millisecond, 0, false, ErrCredentialsBusy, 30 * time.Millisecond},
+		{"request cancelled", 10, time.Second, 0, true, context.Canceled, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &CredentialQueueDepth, tt.depth)
+			setValue(t, &CredentialQueueTimeout, tt.timeout)
+			creds := testCredentials(1)
+			creds[0].MaxConcurrency = 1
+			useCredentials(t, creds...)
+			credentialInFlight[creds[0].Email] = 1
+			for range tt.waiting {
+				credentialQueue.PushBack(&credentialWaiter{granted: make(chan string, 1), queued: true})
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(10*time.Millisecond, cancel)
+			}
+			start := time.Now()
+
+			_, err := acquireCredential(ctx, creds, 0)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed < tt.minDelay {
+				t.Errorf("gave up after %v, want at least %v", elapsed, tt.minDelay)
+			}
+			if got := queuedRequests(); got != tt.waiting {
+				t.Errorf("%d requests queued afterwards, want %d", got, tt.waiting)
+			}
+		})
+	}
+}
+
+func TestCredentialsBusyResponse(t *testing.T) {
+	tests := []struct {
+		name           string
+		timeout        time.Duration
+		wantRetryAfter string
+	}{
+		{"queueing off", 0, "1"},
+		{"queue timeout", 3 * time.Second, "3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &CredentialQueueDepth, 0)
+			setValue(t, &CredentialQueueTimeout, tt.timeout)
+			creds := testCredentials(1)
+			creds[0].MaxConcurrency = 1
+			useCredentials(t, creds...)
+			credentialInFlight[creds[0].Email] = 1
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+
+			w := postChat(t, chatBody(""), nil)
+
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503; body %s", w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetryAfter)
+			}
+		})
+	}
+}
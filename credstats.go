@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// credentialStats tracks recent upstream outcomes for one credential
+type credentialStats struct {
+	Successes   int64
+	Failures    int64
+	LastStatus  int
+	LastError   string
+	LastUsedAt  time.Time
+	LastFailure time.Time
+
+	// Set by the background health check; unhealthy credentials are skipped in rotation
+	Unhealthy     bool
+	LastCheckedAt time.Time
+
+	// Quota reported by the gateway's rate-limit headers; nil remaining means unknown.
+	// Until RateLimitedUntil the credential is skipped in rotation.
+	RateLimitRemaining *int
+	RateLimitReset     time.Time
+	RateLimitedUntil   time.Time
+}
+
+// rateLimited reports whether the credential's quota is exhausted at the given time
+func (s credentialStats) rateLimited(now time.Time) bool {
+	return now.Before(s.RateLimitedUntil)
+}
+
+var (
+	credStatsMu sync.Mutex
+	credStats   = make(map[string]*credentialStats)
+)
+
+// recordCredentialResult updates the stats of the credential identified by email.
+// status is the upstream HTTP status, or 0 when the request failed before a response.
+func recordCredentialResult(email string, status int, err error) {
+	credStatsMu.Lock()
+	defer credStatsMu.Unlock()
+
+	stats, ok := credStats[email]
+	if !ok {
+		stats = &credentialStats{}
+		credStats[email] = stats
+	}
+
+	now := time.Now()
+	stats.LastUsedAt = now
+	stats.LastStatus = status
+	if err == nil && status < 400 {
+		stats.Successes++
+		stats.LastError = ""
+		return
+	}
+
+	stats.Failures++
+	stats.LastFailure = now
+	if err != nil {
+		stats.LastError = err.Error()
+	} else {
+		stats.LastError = ""
+	}
+}
+
+// recordRateLimit updates a credential's quota from X-RateLimit-Remaining and
+// X-RateLimit-Reset (or Retry-After on a 429). A credential with no quota left
+// is marked rate limited until the reported reset time.
+func recordRateLimit(email string, status int, header http.Header) {
+	now := time.Now()
+	remaining, hasRemaining := parseRateLimitRemaining(header.Get("X-RateLimit-Remaining"))
+	reset, hasReset := parseRateLimitReset(header.Get("X-RateLimit-Reset"), now)
+	if !hasReset && status == http.StatusTooManyRequests {
+		reset, hasReset = parseRetryAfter(header.Get("Retry-After"), now)
+	}
+	if !hasRemaining && !hasReset {
+		return
+	}
+
+	credStatsMu.Lock()
+	defer credStatsMu.Unlock()
+
+	stats, ok := credStats[email]
+	if !ok {
+		stats = &credentialStats{}
+		credStats[email] = stats
+	}
+
+	if hasRemaining {
+		stats.RateLimitRemaining = &remaining
+	}
+	if hasReset {
+		stats.RateLimitReset = reset
+	}
+
+	exhausted := status == http.StatusTooManyRequests || (hasRemaining && remaining <= 0)
+	switch {
+	case exhausted && hasReset:
+		stats.RateLimitedUntil = reset
+	case !exhausted:
+		stats.RateLimitedUntil = time.Time{}
+	}
+}
+
+// parseRateLimitRemaining parses an X-RateLimit-Remaining value
+func parseRateLimitRemaining(value string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// parseRateLimitReset parses an X-RateLimit-Reset value given either as a Unix
+// timestamp or as seconds from now
+func parseRateLimitReset(value string, now time.Time) (time.Time, bool) {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || seconds < 0 {
+		return time.Time{}, false
+	}
+	if seconds > 1e9 {
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	}
+	return now.Add(time.Duration(seconds * float64(time.Second))), true
+}
+
+// parseRetryAfter parses a Retry-After value in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// setCredentialHealth records a health-check result and reports whether the state changed
+func setCredentialHealth(email string, healthy bool) bool {
+	credStatsMu.Lock()
+	defer credStatsMu.Unlock()
+
+	stats, ok := credStats[email]
+	if !ok {
+		stats = &credentialStats{}
+		credStats[email] = stats
+	}
+
+	stats.LastCheckedAt = time.Now()
+	changed := stats.Unhealthy == healthy
+	stats.Unhealthy = !healthy
+	return changed
+}
+
+// pruneCredentialStats drops the stats of credentials that are no longer loaded
+// and returns how many were removed
+func pruneCredentialStats(credentials []Credential) int {
+	loaded := make(map[string]bool, len(credentials))
+	for _, cred := range credentials {
+		loaded[cred.Email] = true
+	}
+
+	credStatsMu.Lock()
+	defer credStatsMu.Unlock()
+
+	removed := 0
+	for email := range credStats {
+		if !loaded[email] {
+			delete(credStats, email)
+			removed++
+		}
+	}
+	return removed
+}
+
+// getCredentialStats returns a copy of the stats for a credential
+func getCredentialStats(email string) credentialStats {
+	credStatsMu.Lock()
+	defer credStatsMu.Unlock()
+
+	if stats, ok := credStats[email]; ok {
+		return *stats
+	}
+	return credentialStats{}
+}
+
+// maskEmail keeps the first two characters of an address's local part and its
+// domain, enough to tell credentials apart without exposing the address
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return maskToken(email)
+	}
+	if len(local) > 2 {
+		local = local[:2]
+	}
+	return local + "***@" + domain
+}
+
+// maskToken hides all but the first and last four characters of a secret
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return "********"
+	}
+	return token[:4] + "…" + token[len(token)-4:]
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMaskToken(t *testing.T) {
+	tests := []struct {
+		token, want string
+	}{
+		{"", "********"},
+		{"short", "********"},
+		{"12345678", "********"},
+		{"123456789", "1234…6789"},
+		{"ATATT3xFfGF0abcdefghijklmnop", "ATAT…mnop"},
+	}
+	for _, tt := range tests {
+		if got := maskToken(tt.token); got != tt.want {
+			t.Errorf("maskToken(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	resetAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	unix := strconv.FormatInt(resetAt.Unix(), 10)
+	tests := []struct {
+		name        string
+		status      int
+		header      http.Header
+		wantLimited bool
+		wantRemain  int
+	}{
+		{"quota left", http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"5"}, "X-Ratelimit-Reset": {unix}}, false, 5},
+		{"quota exhausted", http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {unix}}, true, 0},
+		{"relative reset", http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"3600"}}, true, 0},
+		{"429 with retry-after", http.StatusTooManyRequests, http.Header{"Retry-After": {"3600"}}, true, -1},
+		{"429 with http date", http.StatusTooManyRequests, http.Header{"Retry-After": {resetAt.UTC().Format(http.TimeFormat)}}, true, -1},
+		{"no headers", http.StatusTooManyRequests, http.Header{}, false, -1},
+		{"malformed headers", http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"many"}, "X-Ratelimit-Reset": {"later"}}, false, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+
+			recordRateLimit("c0@example.com", tt.status, tt.header)
+
+			stats := getCredentialStats("c0@example.com")
+			if got := stats.rateLimited(time.Now()); got != tt.wantLimited {
+				t.Errorf("rate limited = %v, want %v (until %v)", got, tt.wantLimited, stats.RateLimitedUntil)
+			}
+			if tt.wantLimited && stats.rateLimited(resetAt.Add(time.Second)) {
+				t.Errorf("still rate limited after the reset at %v", stats.RateLimitedUntil)
+			}
+			switch {
+			case tt.wantRemain < 0 && stats.RateLimitRemaining != nil:
+				t.Errorf("remaining = %d, want unknown", *stats.RateLimitRemaining)
+			case tt.wantRemain >= 0 && (stats.RateLimitRemaining == nil || *stats.RateLimitRemaining != tt.wantRemain):
+				t.Errorf("remaining = %v, want %d", stats.RateLimitRemaining, tt.wantRemain)
+			}
+		})
+	}
+}
+
+func TestRecordRateLimitClearsOnRecovery(t *testing.T) {
+	useCredentials(t, testCredentials(1)...)
+	recordRateLimit("c0@example.com", http.StatusTooManyRequests, http.Header{"Retry-After": {"3600"}})
+
+	recordRateLimit("c0@example.com", http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"10"}})
+
+	if getCredentialStats("c0@example.com").rateLimited(time.Now()) {
+		t.Error("credential still rate limited after the gateway reported quota")
+	}
+}
+
+func TestRateLimitedCredentialSkipped(t *testing.T) {
+	setValue(t, &CredentialStrategy, "priority")
+	useCredentials(t, testCredentials(2)...)
+	var used []string
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		used = append(used, requestEmail(r))
+		if requestEmail(r) == "c0@example.com" {
+			resp := jsonResponse(http.StatusTooManyRequests, `{}`)
+			resp.Header.Set("Retry-After", "3600")
+			return resp, nil
+		}
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	for range 2 {
+		if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"c0@example.com", "c1@example.com", "c1@example.com"}
+	if !slices.Equal(used, want) {
+		t.Errorf("used %v, want %v", used, want)
+	}
+}
+
+func TestMaskEmail(t *testing.T) {
+	tests := []struct {
+		email, want string
+	}{
+		{"alice@example.com", "al***@example.com"},
+		{"al@example.com", "al***@example.com"},
+		{"a@example.com", "a***@example.com"},
+		{"short", "********"},
+		{"not-an-email", "not-…mail"},
+	}
+	for _, tt := range tests {
+		if got := maskEmail(tt.email); got != tt.want {
+			t.Errorf("maskEmail(%q) = %q, want %q", tt.email, got, tt.want)
+		}
+	}
+}
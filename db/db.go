@@ -3,11 +3,12 @@ package db
 import (
 	"crypto/rand"
 	"encoding/hex"
-	"fmt"
+	"errors"
 	"log"
 	"math/big"
 	"os"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,14 +16,25 @@ import (
 
 	"gorm.io/driver/postgres" // Changed from sqlite
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
+// ErrDuplicateCredential is returned when a credential with the same email already exists
+var ErrDuplicateCredential = errors.New("credential with this email already exists")
+
 // Credential represents the credential model in the database
 type Credential struct {
-	ID    uint   `gorm:"primarykey"`
-	Email string `gorm:"uniqueIndex;not null"`
-	Token string `gorm:"not null"`
+	ID     uint   `gorm:"primarykey"`
+	Email  string `gorm:"uniqueIndex;not null"`
+	Token  string `gorm:"not null"`
+	Models string // Comma-separated model IDs this credential may serve; empty means all
+
+	// Concurrent upstream requests allowed on this credential; 0 uses CREDENTIAL_MAX_CONCURRENCY
+	MaxConcurrency int `gorm:"not null;default:0"`
+
+	// Relative share of requests under weighted selection; nil means 1
+	Weight *int
 }
 
 // APIToken represents an API access token
@@ -30,6 +42,7 @@ type APIToken struct {
 	ID        uint   `gorm:"primarykey"`
 	Token     string `gorm:"uniqueIndex;not null"`
 	CreatedAt time.Time
+	Models    string // Comma-separated model IDs this token may use; empty means all
 }
 
 // AdminPassword represents the admin password
@@ -40,6 +53,71 @@ type AdminPassword struct {
 	CreatedAt    time.Time
 }
 
+// RecoveryToken is a single-use token for resetting the admin password without a session
+type RecoveryToken struct {
+	ID        uint      `gorm:"primarykey"`
+	TokenHash string    `gorm:"uniqueIndex;not null"` // SHA-256 of the token
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// AuditLog records an administrative action
+type AuditLog struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	UserID    uint
+	Action    string `gorm:"not null"`
+	Target    string
+	IP        string
+}
+
+// RequestLog records one /v1/chat/completions call for usage accounting
+type RequestLog struct {
+	ID               uint      `gorm:"primarykey"`
+	CreatedAt        time.Time `gorm:"index"`
+	TokenHash        string    `gorm:"index;not null"` // SHA-256 of the API token
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Status           int
+	Metadata         string // JSON object of the client-supplied request metadata
+}
+
+// DisabledModel marks a supported model as temporarily unavailable
+type DisabledModel struct {
+	ModelID   string `gorm:"primarykey"`
+	CreatedAt time.Time
+}
+
+// JWTSecret stores the admin session signing secret set by a runtime rotation,
+// so the rotation survives restarts. It is used only while JWT_SECRET is unset;
+// an explicitly configured secret always wins. It is stored as is, since it is
+// needed to sign tokens, so the database must be protected like JWT_SECRET.
+type JWTSecret struct {
+	ID        uint   `gorm:"primarykey"`
+	Secret    string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+// UsageSummary aggregates request logs per API token per day
+type UsageSummary struct {
+	Day              string
+	TokenHash        string
+	Requests         int64
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// ModelUsageSummary aggregates request logs for one model on one day
+type ModelUsageSummary struct {
+	Day              string `json:"day"`
+	Model            string `json:"model"`
+	Requests         int64  `json:"requests"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+}
+
 var (
 	db     *gorm.DB
 	dbOnce sync.Once
@@ -55,10 +133,13 @@ func InitDB() (*gorm.DB, error) {
 			log.Println("DATABASE_URL environment variable not set. Using default SQLite for local development.")
 			// Fallback to SQLite for local development if DATABASE_URL is not set
 			dbPath := "./credentials_dev.db" // Local dev database file
+			// WAL lets readers proceed during writes; busy_timeout waits on locks instead of failing
+			dsn := dbPath + "?_journal_mode=WAL&_busy_timeout=5000"
 			config := &gorm.Config{
-				Logger: logger.Default.LogMode(logger.Silent),
+				Logger:         logger.Default.LogMode(logger.Silent),
+				TranslateError: true,
 			}
-			db, err = gorm.Open(sqlite.Open(dbPath), config) // Keep sqlite for fallback
+			db, err = gorm.Open(sqlite.Open(dsn), config) // Keep sqlite for fallback
 			if err != nil {
 				log.Printf("Failed to connect to local SQLite database: %v", err)
 				return
@@ -66,7 +147,8 @@ func InitDB() (*gorm.DB, error) {
 		} else {
 			// Configure GORM for PostgreSQL
 			config := &gorm.Config{
-				Logger: logger.Default.LogMode(logger.Silent),
+				Logger:         logger.Default.LogMode(logger.Silent),
+				TranslateError: true,
 			}
 
 			// Connect to PostgreSQL database
@@ -75,10 +157,21 @@ func InitDB() (*gorm.DB, error) {
 				log.Printf("Failed to connect to PostgreSQL database: %v", err)
 				return
 			}
+
+			// Configure connection pool
+			sqlDB, poolErr := db.DB()
+			if poolErr != nil {
+				err = poolErr
+				log.Printf("Failed to get PostgreSQL connection pool: %v", err)
+				return
+			}
+			sqlDB.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 10))
+			sqlDB.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 5))
+			sqlDB.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute))
 		}
 
-		// Auto migrate table structure
-		err = db.AutoMigrate(&Credential{}, &APIToken{}, &AdminPassword{})
+		// Apply versioned schema migrations
+		err = runMigrations(db)
 		if err != nil {
 			log.Printf("Failed to migrate table structure: %v", err)
 			return
@@ -88,6 +181,42 @@ func InitDB() (*gorm.DB, error) {
 	return db, err
 }
 
+// envInt reads a non-negative integer environment variable with a default
+func envInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("Invalid value for %s: %q, using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// envString reads a string environment variable with a default
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envDuration reads a non-negative duration environment variable (e.g. "30m") with a default
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("Invalid value for %s: %q, using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
 // ensureDBDir is no longer needed for PostgreSQL, but kept for SQLite fallback
 func ensureDBDir(dbPath string) error {
 	dir := filepath.Dir(dbPath)
@@ -114,21 +243,80 @@ func GetAllCredentials() ([]Credential, error) {
 }
 
 // AddCredential adds a new credential
-func AddCredential(email, token string) error {
+func AddCredential(email, token, models string, maxConcurrency int, weight *int) error {
 	credential := Credential{
-		Email: email,
-		Token: token,
+		Email:          email,
+		Token:          token,
+		Models:         models,
+		MaxConcurrency: maxConcurrency,
+		Weight:         weight,
 	}
 	result := GetDB().Create(&credential)
+	if errors.Is(result.Error, gorm.ErrDuplicatedKey) {
+		return ErrDuplicateCredential
+	}
+	return result.Error
+}
+
+// UpsertCredential adds a credential or replaces the token, models, concurrency limit
+// and weight of an existing one with the same email
+func UpsertCredential(email, token, models string, maxConcurrency int, weight *int) error {
+	credential := Credential{
+		Email:          email,
+		Token:          token,
+		Models:         models,
+		MaxConcurrency: maxConcurrency,
+		Weight:         weight,
+	}
+	result := GetDB().Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"token", "models", "max_concurrency", "weight"}),
+	}).Create(&credential)
 	return result.Error
 }
 
+// CountCredentials returns the number of stored credentials
+func CountCredentials() (int64, error) {
+	var count int64
+	result := GetDB().Model(&Credential{}).Count(&count)
+	return count, result.Error
+}
+
+// CredentialExists reports whether a credential with the given email is stored
+func CredentialExists(email string) (bool, error) {
+	var count int64
+	result := GetDB().Model(&Credential{}).Where("email = ?", email).Count(&count)
+	return count > 0, result.Error
+}
+
 // DeleteCredential deletes a credential
 func DeleteCredential(id uint) error {
 	result := GetDB().Delete(&Credential{}, id)
 	return result.Error
 }
 
+// DeleteCredentials deletes several credentials in one transaction. IDs that
+// don't exist are skipped; it returns the IDs that were actually deleted.
+func DeleteCredentials(ids []uint) ([]uint, error) {
+	var deleted []uint
+	err := GetDB().Transaction(func(tx *gorm.DB) error {
+		for _, id := range ids {
+			result := tx.Delete(&Credential{}, id)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 {
+				deleted = append(deleted, id)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
 // GetCredentialByID gets a credential by ID
 func GetCredentialByID(id uint) (Credential, error) {
 	var credential Credential
@@ -155,7 +343,9 @@ func GetAPIToken() (string, error) {
 	return token.Token, nil
 }
 
-// GenerateAPIToken generates a new API token
+// GenerateAPIToken generates a new API token prefixed with API_TOKEN_PREFIX (default "sk-").
+// Validation matches the stored value exactly, so changing the prefix doesn't
+// invalidate tokens that were issued with a previous one.
 func GenerateAPIToken() (string, error) {
 	// Generate random token
 	b := make([]byte, 32)
@@ -163,7 +353,11 @@ func GenerateAPIToken() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	token := fmt.Sprintf("sk-%s", hex.EncodeToString(b))
+	token := envString("API_TOKEN_PREFIX", "sk-") + hex.EncodeToString(b)
+
+	// The model allowlist carries over to the replacement token
+	var previous APIToken
+	GetDB().First(&previous)
 
 	// Delete all existing tokens
 	GetDB().Where("1=1").Delete(&APIToken{})
@@ -172,6 +366,7 @@ func GenerateAPIToken() (string, error) {
 	apiToken := APIToken{
 		Token:     token,
 		CreatedAt: time.Now(),
+		Models:    previous.Models,
 	}
 	result := GetDB().Create(&apiToken)
 	if result.Error != nil {
@@ -181,6 +376,29 @@ func GenerateAPIToken() (string, error) {
 	return token, nil
 }
 
+// GetAPITokenModels returns the model allowlist of the current API token
+func GetAPITokenModels() (string, error) {
+	var token APIToken
+	result := GetDB().First(&token)
+	return token.Models, result.Error
+}
+
+// SetAPITokenModels replaces the model allowlist of the current API token
+func SetAPITokenModels(models string) error {
+	result := GetDB().Model(&APIToken{}).Where("1=1").Update("models", models)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return result.Error
+}
+
+// APITokenModels returns the model allowlist of the given API token
+func APITokenModels(token string) (string, error) {
+	var apiToken APIToken
+	result := GetDB().Where("token = ?", token).First(&apiToken)
+	return apiToken.Models, result.Error
+}
+
 // ValidateAPIToken validates an API token
 func ValidateAPIToken(token string) bool {
 	var count int64
@@ -210,18 +428,195 @@ func GetAdminPassword() (string, bool, error) {
 	if result.Error != nil {
 		return "", false, result.Error
 	}
-	return adminPassword.PasswordHash, *adminPassword.IsInitial, nil
+	return adminPassword.PasswordHash, adminPassword.isInitial(), nil
 }
 
-// IsPasswordInitial checks if the current password is the initial password
+// IsPasswordInitial checks if the current password is the initial password.
+// A missing password row counts as initial.
 func IsPasswordInitial() (bool, error) {
 	var adminPassword AdminPassword
 	result := GetDB().First(&adminPassword)
-	fmt.Printf("adminPassword: %v\n", adminPassword)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return true, nil
+	}
 	if result.Error != nil {
 		return true, result.Error
 	}
-	return *adminPassword.IsInitial, nil
+	return adminPassword.isInitial(), nil
+}
+
+// isInitial treats a NULL flag as initial, matching the column default
+func (p AdminPassword) isInitial() bool {
+	return p.IsInitial == nil || *p.IsInitial
+}
+
+// AddAuditLog records an admin action
+func AddAuditLog(userID uint, action, target, ip string) error {
+	entry := AuditLog{
+		CreatedAt: time.Now(),
+		UserID:    userID,
+		Action:    action,
+		Target:    target,
+		IP:        ip,
+	}
+	result := GetDB().Create(&entry)
+	return result.Error
+}
+
+// GetAuditLogs returns one page of audit entries, newest first, and the total count
+func GetAuditLogs(page, pageSize int) ([]AuditLog, int64, error) {
+	var total int64
+	if err := GetDB().Model(&AuditLog{}).Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var entries []AuditLog
+	result := GetDB().Order("id DESC").Offset((page - 1) * pageSize).Limit(pageSize).Find(&entries)
+	return entries, total, result.Error
+}
+
+// AddRequestLogs stores a batch of request log entries
+func AddRequestLogs(entries []RequestLog) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	result := GetDB().Create(&entries)
+	return result.Error
+}
+
+// GetDailyUsage aggregates request logs per token per day since the given time, newest day first
+func GetDailyUsage(since time.Time) ([]UsageSummary, error) {
+	var summaries []UsageSummary
+	result := GetDB().Model(&RequestLog{}).
+		Select("CAST(DATE(created_at) AS TEXT) AS day, token_hash, COUNT(*) AS requests, "+
+			"SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens").
+		Where("created_at >= ?", since).
+		Group("DATE(created_at), token_hash").
+		Order("day DESC, requests DESC").
+		Scan(&summaries)
+	return summaries, result.Error
+}
+
+// GetModelUsage aggregates request logs per model per day in [from, to), oldest
+// day first. A zero to leaves the range open-ended.
+func GetModelUsage(from, to time.Time) ([]ModelUsageSummary, error) {
+	query := GetDB().Model(&RequestLog{}).
+		Select("CAST(DATE(created_at) AS TEXT) AS day, model, COUNT(*) AS requests, "+
+			"SUM(prompt_tokens) AS prompt_tokens, SUM(completion_tokens) AS completion_tokens").
+		Where("created_at >= ?", from)
+	if !to.IsZero() {
+		query = query.Where("created_at < ?", to)
+	}
+
+	var summaries []ModelUsageSummary
+	result := query.
+		Group("DATE(created_at), model").
+		Order("day, model").
+		Scan(&summaries)
+	return summaries, result.Error
+}
+
+// PurgeRequestLogs deletes request logs created before the given time and returns how many were removed
+func PurgeRequestLogs(before time.Time) (int64, error) {
+	result := GetDB().Where("created_at < ?", before).Delete(&RequestLog{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeAuditLogs deletes audit entries created before the given time and returns how many were removed
+func PurgeAuditLogs(before time.Time) (int64, error) {
+	result := GetDB().Where("created_at < ?", before).Delete(&AuditLog{})
+	return result.RowsAffected, result.Error
+}
+
+// PurgeRecoveryTokens deletes recovery tokens that are used or expired and returns how many were removed
+func PurgeRecoveryTokens() (int64, error) {
+	result := GetDB().Where("used_at IS NOT NULL OR expires_at < ?", time.Now()).Delete(&RecoveryToken{})
+	return result.RowsAffected, result.Error
+}
+
+// GetDisabledModels returns the IDs of all disabled models
+func GetDisabledModels() ([]string, error) {
+	var ids []string
+	result := GetDB().Model(&DisabledModel{}).Order("model_id").Pluck("model_id", &ids)
+	return ids, result.Error
+}
+
+// SetModelDisabled disables or re-enables a model
+func SetModelDisabled(modelID string, disabled bool) error {
+	if !disabled {
+		return GetDB().Delete(&DisabledModel{}, "model_id = ?", modelID).Error
+	}
+	return GetDB().Clauses(clause.OnConflict{DoNothing: true}).
+		Create(&DisabledModel{ModelID: modelID, CreatedAt: time.Now()}).Error
+}
+
+// SetJWTSecret replaces the persisted JWT signing secret
+func SetJWTSecret(secret string) error {
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("1=1").Delete(&JWTSecret{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&JWTSecret{Secret: secret, CreatedAt: time.Now()}).Error
+	})
+}
+
+// GetJWTSecret returns the persisted JWT signing secret, or "" if none was rotated in
+func GetJWTSecret() (string, error) {
+	var secret JWTSecret
+	result := GetDB().First(&secret)
+	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+		return "", nil
+	}
+	if result.Error != nil {
+		return "", result.Error
+	}
+	return secret.Secret, nil
+}
+
+// Recovery token errors
+var (
+	ErrRecoveryTokenInvalid = errors.New("recovery token is invalid")
+	ErrRecoveryTokenExpired = errors.New("recovery token has expired")
+	ErrRecoveryTokenUsed    = errors.New("recovery token has already been used")
+)
+
+// CreateRecoveryToken stores the hash of a new recovery token valid until expiresAt
+func CreateRecoveryToken(tokenHash string, expiresAt time.Time) error {
+	return GetDB().Create(&RecoveryToken{
+		TokenHash: tokenHash,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// ConsumeRecoveryToken marks a recovery token as used. It fails if the token
+// is unknown, expired or already used, so each token works at most once.
+func ConsumeRecoveryToken(tokenHash string) error {
+	now := time.Now()
+	return GetDB().Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&RecoveryToken{}).
+			Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 1 {
+			return nil
+		}
+
+		// Work out why it was rejected
+		var token RecoveryToken
+		if err := tx.Where("token_hash = ?", tokenHash).First(&token).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrRecoveryTokenInvalid
+			}
+			return err
+		}
+		if token.UsedAt != nil {
+			return ErrRecoveryTokenUsed
+		}
+		return ErrRecoveryTokenExpired
+	})
 }
 
 // GenerateRandomPassword generates a random password
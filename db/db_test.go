@@ -0,0 +1,342 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMain runs the tests against a throwaway SQLite database
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "db-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	if _, err := InitDB(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// resetTable deletes every row of model's table
+func resetTable(t *testing.T, model interface{}) {
+	t.Helper()
+	if err := GetDB().Where("1 = 1").Delete(model).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAddCredentialDuplicate(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		email    string
+		wantErr  error
+	}{
+		{"new email", "", "a@example.com", nil},
+		{"different email", "a@example.com", "b@example.com", nil},
+		{"same email", "a@example.com", "a@example.com", ErrDuplicateCredential},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTable(t, &Credential{})
+			if tt.existing != "" {
+				if err := AddCredential(tt.existing, "token-1", "", 0, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := AddCredential(tt.email, "token-2", "", 0, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AddCredential() = %v, want %v", err, tt.wantErr)
+			}
+
+			// Overwriting an existing email succeeds and replaces its token
+			if err := UpsertCredential(tt.email, "token-3", "", 0, nil); err != nil {
+				t.Fatalf("UpsertCredential() = %v", err)
+			}
+			count, err := CountCredentials()
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := int64(1)
+			if tt.existing != "" && tt.existing != tt.email {
+				want = 2
+			}
+			if count != want {
+				t.Errorf("credentials = %d, want %d", count, want)
+			}
+		})
+	}
+}
+
+func TestSQLitePragmas(t *testing.T) {
+	tests := []struct {
+		pragma string
+		want   string
+	}{
+		{"journal_mode", "wal"},
+		{"busy_timeout", "5000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pragma, func(t *testing.T) {
+			var got string
+			if err := GetDB().Raw("PRAGMA " + tt.pragma).Scan(&got).Error; err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("PRAGMA %s = %q, want %q", tt.pragma, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoolSettingsFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		wantInt int
+		wantDur time.Duration
+	}{
+		{"unset uses defaults", "", 10, 30 * time.Minute},
+		{"invalid uses defaults", "lots", 10, 30 * time.Minute},
+		{"integer", "25", 25, 30 * time.Minute},
+		{"duration", "5m", 10, 5 * time.Minute},
+		{"negative integer uses default", "-3", 10, 30 * time.Minute},
+		{"negative duration uses default", "-5m", 10, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_TEST_SETTING", tt.value)
+			if got := envInt("DB_TEST_SETTING", 10); got != tt.wantInt {
+				t.Errorf("envInt() = %d, want %d", got, tt.wantInt)
+			}
+			if got := envDuration("DB_TEST_SETTING", 30*time.Minute); got != tt.wantDur {
+				t.Errorf("envDuration() = %v, want %v", got, tt.wantDur)
+			}
+		})
+	}
+}
+
+func TestGetAuditLogs(t *testing.T) {
+	resetTable(t, &AuditLog{})
+	for _, action := range []string{"a", "b", "c", "d", "e"} {
+		if err := AddAuditLog(1, action, "", "127.0.0.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		page, pageSize int
+		want           []string
+	}{
+		{1, 2, []string{"e", "d"}},
+		{2, 2, []string{"c", "b"}},
+		{3, 2, []string{"a"}},
+		{4, 2, nil},
+	}
+	for _, tt := range tests {
+		entries, total, err := GetAuditLogs(tt.page, tt.pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 {
+			t.Errorf("page %d: total = %d, want 5", tt.page, total)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Action)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("page %d = %v, want %v", tt.page, got, tt.want)
+		}
+	}
+}
+
+func TestIsPasswordInitial(t *testing.T) {
+	initial, changed := true, false
+	tests := []struct {
+		name string
+		row  *AdminPassword
+		want bool
+	}{
+		{"no row", nil, true},
+		{"initial", &AdminPassword{PasswordHash: "h", IsInitial: &initial}, true},
+		{"changed", &AdminPassword{PasswordHash: "h", IsInitial: &changed}, false},
+		{"null flag", &AdminPassword{PasswordHash: "h"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTable(t, &AdminPassword{})
+			if tt.row != nil {
+				if err := GetDB().Create(tt.row).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Nothing may be printed to stdout
+			stdout := os.Stdout
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			os.Stdout = w
+			got, err := IsPasswordInitial()
+			os.Stdout = stdout
+			w.Close()
+			printed, _ := io.ReadAll(r)
+
+			if err != nil {
+				t.Fatalf("IsPasswordInitial() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("IsPasswordInitial() = %v, want %v", got, tt.want)
+			}
+			if len(printed) > 0 {
+				t.Errorf("IsPasswordInitial() printed %q", printed)
+			}
+		})
+	}
+}
+
+func TestGenerateAPITokenPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		want   string
+	}{
+		{"default", "", "sk-"},
+		{"custom", "kel-", "kel-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTable(t, &APIToken{})
+			t.Setenv("API_TOKEN_PREFIX", tt.prefix)
+
+			token, err := GenerateAPIToken()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			secret, ok := strings.CutPrefix(token, tt.want)
+			if !ok || len(secret) != 64 {
+				t.Errorf("token = %q, want %q followed by 64 hex characters", token, tt.want)
+			}
+			// Changing the prefix later doesn't invalidate the token
+			t.Setenv("API_TOKEN_PREFIX", "other-")
+			if !ValidateAPIToken(token) {
+				t.Errorf("ValidateAPIToken(%q) = false after the prefix changed", token)
+			}
+		})
+	}
+}
+
+func TestConsumeRecoveryToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn time.Duration
+		used      bool
+		hash      string
+		wantErr   error
+	}{
+		{"valid", time.Minute, false, "recovery-hash", nil},
+		{"already used", time.Minute, true, "recovery-hash", ErrRecoveryTokenUsed},
+		{"expired", -time.Minute, false, "recovery-hash", ErrRecoveryTokenExpired},
+		{"unknown", time.Minute, false, "other-hash", ErrRecoveryTokenInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTable(t, &RecoveryToken{})
+			if err := CreateRecoveryToken("recovery-hash", time.Now().Add(tt.expiresIn)); err != nil {
+				t.Fatal(err)
+			}
+			if tt.used {
+				if err := ConsumeRecoveryToken("recovery-hash"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := ConsumeRecoveryToken(tt.hash)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ConsumeRecoveryToken() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAPITokenModels(t *testing.T) {
+	resetTable(t, &APIToken{})
+	if err := SetAPITokenModels("a,b"); err == nil {
+		t.Error("SetAPITokenModels() succeeded without a token")
+	}
+	first, err := GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetAPITokenModels("a,b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The allowlist carries over to a regenerated token
+	second, err := GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if models, err := APITokenModels(second); err != nil || models != "a,b" {
+		t.Errorf("APITokenModels(new token) = %q, %v; want %q", models, err, "a,b")
+	}
+	if models, err := GetAPITokenModels(); err != nil || models != "a,b" {
+		t.Errorf("GetAPITokenModels() = %q, %v; want %q", models, err, "a,b")
+	}
+	if _, err := APITokenModels(first); err == nil {
+		t.Error("APITokenModels(replaced token) succeeded")
+	}
+}
+
+func TestGetDailyUsage(t *testing.T) {
+	resetTable(t, &RequestLog{})
+	day := func(d, hour int) time.Time { return time.Date(2024, 3, d, hour, 0, 0, 0, time.UTC) }
+	seed := []RequestLog{
+		{CreatedAt: day(1, 9), TokenHash: "token-a", PromptTokens: 10, CompletionTokens: 1},
+		{CreatedAt: day(1, 23), TokenHash: "token-a", PromptTokens: 20, CompletionTokens: 2},
+		{CreatedAt: day(1, 12), TokenHash: "token-b", PromptTokens: 5, CompletionTokens: 5},
+		{CreatedAt: day(2, 0), TokenHash: "token-b", PromptTokens: 7, CompletionTokens: 3},
+		{CreatedAt: day(2, 8), TokenHash: "token-b", PromptTokens: 1, CompletionTokens: 1},
+		{CreatedAt: day(2, 9), TokenHash: "token-a", PromptTokens: 100, CompletionTokens: 100},
+		// Before the window
+		{CreatedAt: time.Date(2024, 2, 28, 12, 0, 0, 0, time.UTC), TokenHash: "token-a", PromptTokens: 1000},
+	}
+	if err := GetDB().Create(&seed).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := GetDailyUsage(day(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Newest day first, busiest token first within a day
+	want := []UsageSummary{
+		{Day: "2024-03-02", TokenHash: "token-b", Requests: 2, PromptTokens: 8, CompletionTokens: 4},
+		{Day: "2024-03-02", TokenHash: "token-a", Requests: 1, PromptTokens: 100, CompletionTokens: 100},
+		{Day: "2024-03-01", TokenHash: "token-a", Requests: 2, PromptTokens: 30, CompletionTokens: 3},
+		{Day: "2024-03-01", TokenHash: "token-b", Requests: 1, PromptTokens: 5, CompletionTokens: 5},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("GetDailyUsage() =\n%+v\nwant\n%+v", got, want)
+	}
+}
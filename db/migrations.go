@@ -0,0 +1,257 @@
+package db
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// SchemaMigration records a migration that has been applied
+type SchemaMigration struct {
+	Version   int    `gorm:"primarykey;autoIncrement:false"`
+	Name      string `gorm:"not null"`
+	AppliedAt time.Time
+}
+
+// migration is a single ordered schema change
+type migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+}
+
+// migrations lists all schema changes in order. Append new entries with an
+// increasing version; never edit or reorder an entry once it has shipped.
+// Each step works on the frozen snapshot types below rather than the live
+// models, so it makes the same change however the models evolve later.
+var migrations = []migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		Up: func(tx *gorm.DB) error {
+			// AutoMigrate is idempotent, so databases created before versioning are adopted as-is
+			return tx.AutoMigrate(&credentialV1{}, &apiTokenV1{}, &adminPasswordV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "add audit log",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&auditLogV2{})
+		},
+	},
+	{
+		Version: 3,
+		Name:    "add credential model restrictions",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &credentialV3{}, "Models")
+		},
+	},
+	{
+		Version: 4,
+		Name:    "add request log",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&requestLogV4{})
+		},
+	},
+	{
+		Version: 5,
+		Name:    "add persisted jwt secret",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&jwtSecretV5{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "add disabled models",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&disabledModelV6{})
+		},
+	},
+	{
+		Version: 7,
+		Name:    "add credential concurrency limits",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &credentialV7{}, "MaxConcurrency")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "add credential weights",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &credentialV8{}, "Weight")
+		},
+	},
+	{
+		Version: 9,
+		Name:    "add request log metadata",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &requestLogV9{}, "Metadata")
+		},
+	},
+	{
+		Version: 10,
+		Name:    "add password recovery tokens",
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&recoveryTokenV10{})
+		},
+	},
+	{
+		Version: 11,
+		Name:    "add api token model allowlists",
+		Up: func(tx *gorm.DB) error {
+			return addColumn(tx, &apiTokenV11{}, "Models")
+		},
+	},
+}
+
+// addColumn adds the snapshot's field as a column unless it already exists, as
+// it may on databases created before migrations were versioned
+func addColumn(tx *gorm.DB, snapshot interface{}, field string) error {
+	if tx.Migrator().HasColumn(snapshot, field) {
+		return nil
+	}
+	return tx.Migrator().AddColumn(snapshot, field)
+}
+
+// Table snapshots as of the migration in their suffix. Column-adding steps
+// only carry the new column.
+
+type credentialV1 struct {
+	ID    uint   `gorm:"primarykey"`
+	Email string `gorm:"uniqueIndex;not null"`
+	Token string `gorm:"not null"`
+}
+
+func (credentialV1) TableName() string { return "credentials" }
+
+type apiTokenV1 struct {
+	ID        uint   `gorm:"primarykey"`
+	Token     string `gorm:"uniqueIndex;not null"`
+	CreatedAt time.Time
+}
+
+func (apiTokenV1) TableName() string { return "api_tokens" }
+
+type adminPasswordV1 struct {
+	ID           uint   `gorm:"primarykey"`
+	PasswordHash string `gorm:"not null"`
+	IsInitial    *bool  `gorm:"default:true"`
+	CreatedAt    time.Time
+}
+
+func (adminPasswordV1) TableName() string { return "admin_passwords" }
+
+type auditLogV2 struct {
+	ID        uint      `gorm:"primarykey"`
+	CreatedAt time.Time `gorm:"index"`
+	UserID    uint
+	Action    string `gorm:"not null"`
+	Target    string
+	IP        string
+}
+
+func (auditLogV2) TableName() string { return "audit_logs" }
+
+type credentialV3 struct {
+	Models string
+}
+
+func (credentialV3) TableName() string { return "credentials" }
+
+type requestLogV4 struct {
+	ID               uint      `gorm:"primarykey"`
+	CreatedAt        time.Time `gorm:"index"`
+	TokenHash        string    `gorm:"index;not null"`
+	Model            string
+	PromptTokens     int
+	CompletionTokens int
+	Status           int
+}
+
+func (requestLogV4) TableName() string { return "request_logs" }
+
+type jwtSecretV5 struct {
+	ID        uint   `gorm:"primarykey"`
+	Secret    string `gorm:"not null"`
+	CreatedAt time.Time
+}
+
+func (jwtSecretV5) TableName() string { return "jwt_secrets" }
+
+type disabledModelV6 struct {
+	ModelID   string `gorm:"primarykey"`
+	CreatedAt time.Time
+}
+
+func (disabledModelV6) TableName() string { return "disabled_models" }
+
+type credentialV7 struct {
+	MaxConcurrency int `gorm:"not null;default:0"`
+}
+
+func (credentialV7) TableName() string { return "credentials" }
+
+type credentialV8 struct {
+	Weight *int
+}
+
+func (credentialV8) TableName() string { return "credentials" }
+
+type requestLogV9 struct {
+	Metadata string
+}
+
+func (requestLogV9) TableName() string { return "request_logs" }
+
+type recoveryTokenV10 struct {
+	ID        uint      `gorm:"primarykey"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+func (recoveryTokenV10) TableName() string { return "recovery_tokens" }
+
+type apiTokenV11 struct {
+	Models string
+}
+
+func (apiTokenV11) TableName() string { return "api_tokens" }
+
+// runMigrations applies every migration that has not been recorded yet
+func runMigrations(conn *gorm.DB) error {
+	if err := conn.AutoMigrate(&SchemaMigration{}); err != nil {
+		return fmt.Errorf("create schema_migrations table: %w", err)
+	}
+
+	for _, m := range migrations {
+		var count int64
+		if err := conn.Model(&SchemaMigration{}).Where("version = ?", m.Version).Count(&count).Error; err != nil {
+			return fmt.Errorf("check migration %d: %w", m.Version, err)
+		}
+		if count > 0 {
+			continue
+		}
+
+		err := conn.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{
+				Version:   m.Version,
+				Name:      m.Name,
+				AppliedAt: time.Now(),
+			}).Error
+		})
+		if err != nil {
+			return fmt.Errorf("apply migration %d (%s): %w", m.Version, m.Name, err)
+		}
+		log.Printf("Applied database migration %d: %s", m.Version, m.Name)
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openTestDB opens an empty SQLite database private to the test
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	conn, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "test.db")), &gorm.Config{
+		Logger: logger.Default.LogMode(logger.Silent),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := conn.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return conn
+}
+
+func TestRunMigrations(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(t *testing.T, conn *gorm.DB)
+	}{
+		{"fresh database", func(*testing.T, *gorm.DB) {}},
+		{"already migrated", func(t *testing.T, conn *gorm.DB) {
+			if err := runMigrations(conn); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"partially migrated", func(t *testing.T, conn *gorm.DB) {
+			if err := conn.AutoMigrate(&SchemaMigration{}); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range migrations[:3] {
+				if err := m.Up(conn); err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.Create(&SchemaMigration{Version: m.Version, Name: m.Name}).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+		}},
+		{"created before versioning", func(t *testing.T, conn *gorm.DB) {
+			// Older releases auto-migrated the models of their day, columns included
+			if err := conn.AutoMigrate(&credentialV1{}, &apiTokenV1{}, &adminPasswordV1{}, &auditLogV2{}); err != nil {
+				t.Fatal(err)
+			}
+			if err := conn.Migrator().AddColumn(&credentialV3{}, "Models"); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := openTestDB(t)
+			tt.setup(t, conn)
+
+			if err := runMigrations(conn); err != nil {
+				t.Fatalf("runMigrations() = %v", err)
+			}
+
+			var applied []SchemaMigration
+			if err := conn.Order("version").Find(&applied).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(applied) != len(migrations) {
+				t.Fatalf("applied %d migrations, want %d", len(applied), len(migrations))
+			}
+			for i, m := range applied {
+				if m.Version != migrations[i].Version {
+					t.Errorf("migration %d has version %d, want %d", i, m.Version, migrations[i].Version)
+				}
+			}
+
+			// The live models must match the schema the migrations build
+			for _, model := range []interface{}{&Credential{}, &APIToken{}, &AdminPassword{}, &AuditLog{},
+				&RequestLog{}, &JWTSecret{}, &DisabledModel{}, &RecoveryToken{}} {
+				stmt := &gorm.Statement{DB: conn}
+				if err := stmt.Parse(model); err != nil {
+					t.Fatal(err)
+				}
+				for _, field := range stmt.Schema.DBNames {
+					if !conn.Migrator().HasColumn(model, field) {
+						t.Errorf("%s lacks column %s", stmt.Schema.Table, field)
+					}
+				}
+			}
+		})
+	}
+}
@@ -3,12 +3,23 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"atlassian/auth"
 	"atlassian/db"
@@ -27,9 +38,11 @@ func SetupRoutes() *gin.Engine {
 	r.Use(func(c *gin.Context) {
 		c.Header("Access-Control-Allow-Origin", "*")
 		c.Header("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		c.Header("Access-Control-Allow-Headers", "Content-Type, Authorization, x-api-key, Idempotency-Key")
 
-		if c.Request.Method == "OPTIONS" {
+		// Preflights on routes with an explicit OPTIONS handler get route-specific
+		// Allow headers; anything else is answered here
+		if c.Request.Method == "OPTIONS" && c.FullPath() == "" {
 			c.AbortWithStatus(http.StatusOK)
 			return
 		}
@@ -41,12 +54,22 @@ func SetupRoutes() *gin.Engine {
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
+	r.GET("/health/upstream", UpstreamHealthCheck)
+
+	// Prometheus metrics
+	r.GET("/metrics", MetricsHandler)
 
 	// OpenAI compatible endpoints
 	v1 := r.Group("/v1")
+	v1.Use(BodySizeLimitMiddleware(MaxRequestBodySize))
 	{
 		v1.GET("/models", ListModels)
+		v1.GET("/models/:model", RetrieveModel)
 		v1.POST("/chat/completions", ChatCompletions)
+
+		v1.OPTIONS("/models", allowMethods("GET"))
+		v1.OPTIONS("/models/:model", allowMethods("GET"))
+		v1.OPTIONS("/chat/completions", allowMethods("POST"))
 	}
 
 	// Admin page routes
@@ -56,6 +79,10 @@ func SetupRoutes() *gin.Engine {
 		admin.GET("/login", ShowLoginPage)
 		admin.POST("/login", HandleLogin)
 
+		// Password recovery with a token issued on the server (-recovery-token)
+		admin.GET("/recover", ShowRecoverPage)
+		admin.POST("/recover", RecoverPassword)
+
 		// Routes requiring authentication
 		authorized := admin.Group("/")
 		authorized.Use(AuthMiddleware())
@@ -64,16 +91,40 @@ func SetupRoutes() *gin.Engine {
 			authorized.GET("/credentials", ShowCredentialsPage)
 			authorized.POST("/credentials", AddCredential)
 			authorized.POST("/credentials/delete/:id", DeleteCredential)
+			authorized.DELETE("/credentials/bulk", BulkDeleteCredentials)
+			authorized.GET("/credentials/reveal/:id", RevealCredential)
 			authorized.GET("/credentials/reload", ReloadCredentialsHandler)
+			authorized.POST("/test-completion", TestCompletion)
 
 			// API token management
 			authorized.POST("/apitoken/generate", GenerateAPITokenHandler)
+			authorized.POST("/apitoken/models", SetAPITokenModelsHandler)
 
 			// Password management
 			authorized.GET("/change-password", ShowChangePasswordPage)
 			authorized.POST("/change-password", ChangePassword)
 			authorized.GET("/reset-password", ShowResetPasswordPage)
 			authorized.POST("/reset-password", ResetPassword)
+			authorized.POST("/rotate-secret", RotateSecret)
+
+			// Audit log
+			authorized.GET("/audit", ShowAuditPage)
+
+			// Usage accounting
+			authorized.GET("/usage", ShowUsagePage)
+			authorized.GET("/api/usage", UsageAPI)
+
+			// Operational status
+			authorized.GET("/status", ShowStatusPage)
+			authorized.GET("/config", ShowConfig)
+
+			// Recent server logs
+			authorized.GET("/logs", ShowLogsPage)
+			authorized.GET("/logs/stream", StreamLogs)
+
+			// Model availability
+			authorized.GET("/models", ShowModelsPage)
+			authorized.POST("/models/toggle", ToggleModel)
 		}
 	}
 
@@ -87,11 +138,268 @@ func SetupRoutes() *gin.Engine {
 	return r
 }
 
+// allowMethods answers an OPTIONS request with the methods the route supports
+func allowMethods(methods ...string) gin.HandlerFunc {
+	allow := strings.Join(append(methods, "OPTIONS"), ", ")
+	return func(c *gin.Context) {
+		c.Header("Allow", allow)
+		c.Header("Access-Control-Allow-Methods", allow)
+		c.AbortWithStatus(http.StatusOK)
+	}
+}
+
+// BodySizeLimitMiddleware caps the size of the request body
+func BodySizeLimitMiddleware(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body != nil {
+			c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		}
+		c.Next()
+	}
+}
+
+// openAIError writes an error response in the OpenAI error object format
+func openAIError(c *gin.Context, status int, errType, message string) {
+	c.JSON(status, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    errType,
+		},
+	})
+}
+
+// openAIParamError writes a 400 invalid_request_error naming the offending parameter
+func openAIParamError(c *gin.Context, param, message string) {
+	c.JSON(http.StatusBadRequest, gin.H{
+		"error": gin.H{
+			"message": message,
+			"type":    "invalid_request_error",
+			"param":   param,
+		},
+	})
+}
+
+// decodeJSONBody decodes a request body into v, rejecting unknown fields when STRICT_JSON is set
+func decodeJSONBody(body io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(body)
+	if StrictJSON {
+		decoder.DisallowUnknownFields()
+	}
+	return decoder.Decode(v)
+}
+
+// describeJSONError turns a decode error into a client-facing message and,
+// where it can be determined, the name of the offending field
+func describeJSONError(err error) (string, string) {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		if typeErr.Field == "" {
+			return "", fmt.Sprintf("Request body must be a JSON %s, got %s", jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		field := jsonFieldPath(typeErr.Field)
+		return field, fmt.Sprintf("Invalid type for '%s': expected %s, got %s",
+			field, jsonTypeName(typeErr.Type), typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return "", fmt.Sprintf("Malformed JSON at byte offset %d: %s", syntaxErr.Offset, syntaxErr.Error())
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return "", "Request body is truncated: unexpected end of JSON input"
+	case errors.Is(err, io.EOF):
+		return "", "Request body is empty"
+	}
+
+	// DisallowUnknownFields reports `json: unknown field "name"`
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		field = strings.Trim(field, `"`)
+		return field, fmt.Sprintf("Unrecognized request argument supplied: %s", field)
+	}
+	return "", "Invalid request body: " + err.Error()
+}
+
+// jsonFieldPath rewrites encoding/json's "messages.0.role" as "messages[0].role"
+func jsonFieldPath(field string) string {
+	parts := strings.Split(field, ".")
+	var b strings.Builder
+	for i, part := range parts {
+		if _, err := strconv.Atoi(part); err == nil && i > 0 {
+			b.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// jsonTypeName names the JSON type a Go type decodes from
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "object"
+	}
+	return t.String()
+}
+
+// validateSamplingParams checks the ranges of optional sampling parameters.
+// It returns the offending parameter name and a message, or empty strings if valid.
+func validateSamplingParams(req *ChatCompletionRequest) (string, string) {
+	if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+		return "temperature", fmt.Sprintf("temperature must be between 0 and 2, got %v", *req.Temperature)
+	}
+	if req.TopP != nil && (*req.TopP < 0 || *req.TopP > 1) {
+		return "top_p", fmt.Sprintf("top_p must be between 0 and 1, got %v", *req.TopP)
+	}
+	return "", ""
+}
+
+// validateConversationLimits enforces MAX_MESSAGES and MAX_PROMPT_CHARS on the
+// client-supplied messages
+func validateConversationLimits(messages []ChatMessage) (string, string) {
+	if MaxMessages > 0 && len(messages) > MaxMessages {
+		return "messages", fmt.Sprintf("Too many messages: %d exceeds the limit of %d", len(messages), MaxMessages)
+	}
+	if MaxPromptChars > 0 {
+		chars := 0
+		for _, msg := range messages {
+			switch v := msg.Content.(type) {
+			case string:
+				chars += utf8.RuneCountInString(v)
+			case []interface{}:
+				for _, part := range v {
+					if partMap, ok := part.(map[string]interface{}); ok {
+						if text, ok := partMap["text"].(string); ok {
+							chars += utf8.RuneCountInString(text)
+						}
+					}
+				}
+			}
+		}
+		if chars > MaxPromptChars {
+			return "messages", fmt.Sprintf("Messages contain %d characters, exceeding the limit of %d", chars, MaxPromptChars)
+		}
+	}
+	return "", ""
+}
+
+// validateMessageRoles checks message roles and tool_call_id, and requires at least one user message
+func validateMessageRoles(messages []ChatMessage) (string, string) {
+	hasUser := false
+	for i, msg := range messages {
+		switch msg.Role {
+		case "user":
+			hasUser = true
+		case "system", "assistant":
+		case "tool":
+			if msg.ToolCallID == "" {
+				return fmt.Sprintf("messages[%d].tool_call_id", i), fmt.Sprintf("messages[%d].tool_call_id is required for role \"tool\"", i)
+			}
+		case "":
+			return fmt.Sprintf("messages[%d].role", i), fmt.Sprintf("messages[%d].role is required", i)
+		default:
+			return fmt.Sprintf("messages[%d].role", i),
+				fmt.Sprintf("messages[%d].role must be one of \"system\", \"user\", \"assistant\" or \"tool\", got %q", i, msg.Role)
+		}
+	}
+	if !hasUser {
+		return "messages", "messages must include at least one message with role \"user\""
+	}
+	return "", ""
+}
+
+// toolNamePattern matches the function names OpenAI accepts
+var toolNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// validateTools checks each tool's function name and that its parameters, if any, are a JSON object
+func validateTools(tools []Tool) (string, string) {
+	for i, tool := range tools {
+		if tool.Type != "" && tool.Type != "function" {
+			return fmt.Sprintf("tools[%d].type", i), fmt.Sprintf("tools[%d].type must be \"function\", got %q", i, tool.Type)
+		}
+		if tool.Function.Name == "" {
+			return fmt.Sprintf("tools[%d].function.name", i), fmt.Sprintf("tools[%d].function.name is required", i)
+		}
+		if !toolNamePattern.MatchString(tool.Function.Name) {
+			return fmt.Sprintf("tools[%d].function.name", i), fmt.Sprintf("tools[%d].function.name must be 1-64 letters, digits, underscores or dashes", i)
+		}
+		if len(tool.Function.Parameters) > 0 && string(tool.Function.Parameters) != "null" {
+			var schema map[string]interface{}
+			if err := json.Unmarshal(tool.Function.Parameters, &schema); err != nil {
+				return fmt.Sprintf("tools[%d].function.parameters", i), fmt.Sprintf("tools[%d].function.parameters must be a JSON schema object", i)
+			}
+			if t, ok := schema["type"]; ok && t != "object" {
+				return fmt.Sprintf("tools[%d].function.parameters", i), fmt.Sprintf("tools[%d].function.parameters must have type \"object\"", i)
+			}
+		}
+	}
+	return "", ""
+}
+
+// validateMetadata enforces OpenAI's limits on the number and size of metadata pairs
+func validateMetadata(metadata map[string]string) (string, string) {
+	if len(metadata) > MaxMetadataPairs {
+		return "metadata", fmt.Sprintf("metadata may have at most %d keys, got %d", MaxMetadataPairs, len(metadata))
+	}
+	for key, value := range metadata {
+		if utf8.RuneCountInString(key) > MaxMetadataKeyLength {
+			return "metadata", fmt.Sprintf("metadata key %q exceeds %d characters", key, MaxMetadataKeyLength)
+		}
+		if utf8.RuneCountInString(value) > MaxMetadataValueLength {
+			return "metadata." + key, fmt.Sprintf("metadata value for %q exceeds %d characters", key, MaxMetadataValueLength)
+		}
+	}
+	return "", ""
+}
+
+// setAdminCookie stores the admin session token in the configured cookie
+func setAdminCookie(c *gin.Context, token string) {
+	c.SetCookie(CookieName, token, 3600, CookiePath, "", false, true)
+}
+
+// clearAdminCookie removes the admin session cookie
+func clearAdminCookie(c *gin.Context) {
+	c.SetCookie(CookieName, "", -1, CookiePath, "", false, true)
+}
+
 // AuthMiddleware authentication middleware
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Scripted clients may authenticate with Basic auth instead of the login cookie
+		if username, password, ok := c.Request.BasicAuth(); ok && AdminBasicAuth {
+			storedHash, isInitial, err := db.GetAdminPassword()
+			if err != nil || username != "admin" || !auth.VerifyPassword(storedHash, password) {
+				c.Header("WWW-Authenticate", `Basic realm="admin"`)
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+				return
+			}
+			// Like the cookie flow, nothing but changing it is allowed with the initial password
+			if isInitial && c.Request.URL.Path != "/admin/change-password" {
+				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "The initial admin password must be changed first (POST /admin/change-password)"})
+				return
+			}
+			c.Set("userID", uint(1)) // Same fixed user ID as the login flow
+			c.Next()
+			return
+		}
+
 		// Get JWT token from cookie
-		tokenString, err := c.Cookie("admin_jwt")
+		tokenString, err := c.Cookie(CookieName)
 		if err != nil {
 			// Not authenticated, redirect to login page
 			c.Redirect(http.StatusFound, "/admin/login")
@@ -103,7 +411,7 @@ func AuthMiddleware() gin.HandlerFunc {
 		claims, err := auth.ParseToken(tokenString)
 		if err != nil {
 			// Invalid token, clear cookie and redirect to login page
-			c.SetCookie("admin_jwt", "", -1, "/", "", false, true)
+			clearAdminCookie(c)
 			c.Redirect(http.StatusFound, "/admin/login")
 			c.Abort()
 			return
@@ -126,6 +434,17 @@ func AuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// recordAudit writes an audit log entry in the background so it doesn't slow the action
+func recordAudit(c *gin.Context, action, target string) {
+	userID := c.GetUint("userID")
+	ip := c.ClientIP()
+	go func() {
+		if err := db.AddAuditLog(userID, action, target, ip); err != nil {
+			log.Printf("Failed to write audit log: %v", err)
+		}
+	}()
+}
+
 // ShowLoginPage displays the login page
 func ShowLoginPage(c *gin.Context) {
 	c.HTML(http.StatusOK, "login.html", gin.H{
@@ -139,7 +458,6 @@ func HandleLogin(c *gin.Context) {
 
 	// Get stored password hash
 	storedHash, isInitial, err := db.GetAdminPassword()
-	fmt.Println(isInitial)
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Failed to get password: " + err.Error(),
@@ -159,7 +477,7 @@ func HandleLogin(c *gin.Context) {
 		}
 
 		// Set JWT cookie
-		c.SetCookie("admin_jwt", token, 3600, "/", "", false, true)
+		setAdminCookie(c, token)
 
 		// If initial password, redirect to change password page
 		if isInitial {
@@ -177,6 +495,11 @@ func HandleLogin(c *gin.Context) {
 
 // ShowCredentialsPage displays the credentials management page
 func ShowCredentialsPage(c *gin.Context) {
+	renderCredentialsPage(c, nil)
+}
+
+// renderCredentialsPage renders the credentials page, merging extra into the template data
+func renderCredentialsPage(c *gin.Context, extra gin.H) {
 	// Get all credentials from database
 	credentials, err := db.GetAllCredentials()
 	if err != nil {
@@ -186,20 +509,117 @@ func ShowCredentialsPage(c *gin.Context) {
 		return
 	}
 
-	// Get API token
+	// Mask tokens; the full value is only available via the reveal endpoint
+	for i := range credentials {
+		credentials[i].Token = maskToken(credentials[i].Token)
+	}
+
+	// Read-only credentials from CREDENTIALS_JSON / CREDENTIALS_FILE
+	var staticCredentials []Credential
+	for _, cred := range loadedCredentials() {
+		if cred.ReadOnly {
+			cred.Token = maskToken(cred.Token)
+			staticCredentials = append(staticCredentials, cred)
+		}
+	}
+
+	// Get API token and its model allowlist
 	apiToken, _ := db.GetAPIToken()
+	apiTokenModels, _ := db.GetAPITokenModels()
+
+	data := gin.H{
+		"title":             "Credential Management",
+		"credentials":       credentials,
+		"staticCredentials": staticCredentials,
+		"apiToken":          apiToken,
+		"apiTokenModels":    apiTokenModels,
+		"enabledModels":     EnabledModels(),
+	}
+	for key, value := range extra {
+		data[key] = value
+	}
+	c.HTML(http.StatusOK, "credentials.html", data)
+}
 
-	c.HTML(http.StatusOK, "credentials.html", gin.H{
-		"title":       "Credential Management",
-		"credentials": credentials,
-		"apiToken":    apiToken,
-	})
+// TestCompletion sends a canned chat request through the normal retry path
+// and shows the reply or the error on the credentials page
+func TestCompletion(c *gin.Context) {
+	model := c.PostForm("model")
+	if model == "" {
+		if enabled := EnabledModels(); len(enabled) > 0 {
+			model = enabled[0]
+		}
+	}
+	recordAudit(c, "completion.test", model)
+
+	reply, err := runTestCompletion(c.Request.Context(), model)
+	result := gin.H{"testModel": model}
+	if err != nil {
+		result["testError"] = err.Error()
+	} else {
+		if reply == "" {
+			reply = "(empty reply)"
+		}
+		result["testResult"] = reply
+	}
+	renderCredentialsPage(c, result)
+}
+
+// runTestCompletion asks model for a short reply and returns its content
+func runTestCompletion(ctx context.Context, model string) (string, error) {
+	if model == "" {
+		return "", fmt.Errorf("no models available")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	// Go through the same transform and concurrency limit as a client request
+	req := ChatCompletionRequest{
+		Model:    model,
+		Messages: []ChatMessage{{Role: "user", Content: "Reply with the single word: pong"}},
+	}
+	body, _, err := buildAtlassianRequest(&req)
+	if err != nil {
+		return "", err
+	}
+
+	release, ok := AcquireUpstreamSlot(ctx)
+	if !ok {
+		return "", fmt.Errorf("too many concurrent requests")
+	}
+	defer release()
+
+	resp, err := SharedHTTPClient().FetchWithRetry(ctx, body, false)
+	if err != nil {
+		if resp != nil {
+			return "", fmt.Errorf("%v: %s", err, upstreamBodySnippet(resp.Body()))
+		}
+		return "", err
+	}
+
+	var atlassianResp AtlassianResponse
+	if err := json.Unmarshal(resp.Body(), &atlassianResp); err != nil {
+		return "", fmt.Errorf("failed to parse upstream response (status %d): %s",
+			resp.StatusCode(), upstreamBodySnippet(resp.Body()))
+	}
+	if atlassianResp.Error != nil {
+		return "", fmt.Errorf("upstream error: %s", atlassianResp.Error.Message)
+	}
+
+	openaiResp := ToOpenAI(atlassianResp, model)
+	if len(openaiResp.Choices) == 0 || openaiResp.Choices[0].Message == nil {
+		return "", fmt.Errorf("upstream returned no choices")
+	}
+	content, _ := openaiResp.Choices[0].Message.Content.(string)
+	return content, nil
 }
 
 // AddCredential adds a new credential
 func AddCredential(c *gin.Context) {
 	email := c.PostForm("email")
 	token := c.PostForm("token")
+	models := normalizeModelList(c.PostForm("models"))
 
 	// Validate input
 	if email == "" || token == "" {
@@ -209,8 +629,60 @@ func AddCredential(c *gin.Context) {
 		return
 	}
 
-	// Add to database
-	err := db.AddCredential(email, token)
+	// Optional per-credential concurrency limit; empty uses the default
+	maxConcurrency := 0
+	if v := strings.TrimSpace(c.PostForm("max_concurrency")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Max concurrency must be a non-negative integer",
+			})
+			return
+		}
+		maxConcurrency = n
+	}
+
+	// Optional weight for weighted credential selection; empty means 1
+	var weight *int
+	if v := strings.TrimSpace(c.PostForm("weight")); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.HTML(http.StatusBadRequest, "error.html", gin.H{
+				"error": "Weight must be a non-negative integer",
+			})
+			return
+		}
+		weight = &n
+	}
+
+	// Enforce MAX_CREDENTIALS; overwriting an existing email doesn't add one
+	if MaxCredentials > 0 {
+		if err := checkCredentialCap(email, c.PostForm("overwrite") == "on"); errors.Is(err, ErrCredentialLimit) {
+			c.HTML(http.StatusConflict, "error.html", gin.H{
+				"error": err.Error(),
+			})
+			return
+		} else if err != nil {
+			c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+				"error": "Failed to add credential: " + err.Error(),
+			})
+			return
+		}
+	}
+
+	// Add to database, optionally overwriting the token of an existing email
+	var err error
+	if c.PostForm("overwrite") == "on" {
+		err = db.UpsertCredential(email, token, models, maxConcurrency, weight)
+	} else {
+		err = db.AddCredential(email, token, models, maxConcurrency, weight)
+	}
+	if errors.Is(err, db.ErrDuplicateCredential) {
+		c.HTML(http.StatusConflict, "error.html", gin.H{
+			"error": "A credential with this email already exists",
+		})
+		return
+	}
 	if err != nil {
 		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
 			"error": "Failed to add credential: " + err.Error(),
@@ -218,6 +690,8 @@ func AddCredential(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "credential.add", email)
+
 	// Reload credentials
 	ReloadCredentials()
 
@@ -225,6 +699,32 @@ func AddCredential(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/admin/credentials")
 }
 
+// ErrCredentialLimit marks an addition rejected because MAX_CREDENTIALS is reached
+var ErrCredentialLimit = errors.New("credential limit reached")
+
+// checkCredentialCap returns ErrCredentialLimit if storing a credential for email
+// would exceed MAX_CREDENTIALS, or the error of a failed lookup
+func checkCredentialCap(email string, overwrite bool) error {
+	if overwrite {
+		exists, err := db.CredentialExists(email)
+		if err != nil {
+			return fmt.Errorf("failed to check credentials: %w", err)
+		}
+		if exists {
+			return nil
+		}
+	}
+
+	count, err := db.CountCredentials()
+	if err != nil {
+		return fmt.Errorf("failed to count credentials: %w", err)
+	}
+	if count >= int64(MaxCredentials) {
+		return fmt.Errorf("%w: at most %d credentials may be stored (MAX_CREDENTIALS)", ErrCredentialLimit, MaxCredentials)
+	}
+	return nil
+}
+
 // DeleteCredential deletes a credential
 func DeleteCredential(c *gin.Context) {
 	idStr := c.Param("id")
@@ -245,6 +745,8 @@ func DeleteCredential(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "credential.delete", idStr)
+
 	// Reload credentials
 	ReloadCredentials()
 
@@ -252,9 +754,95 @@ func DeleteCredential(c *gin.Context) {
 	c.Redirect(http.StatusFound, "/admin/credentials")
 }
 
+// BulkDeleteCredentials deletes the credentials whose IDs are given either as a
+// JSON array (bare or as {"ids": [...]}) or as repeated "ids" form/query fields
+func BulkDeleteCredentials(c *gin.Context) {
+	var ids []uint
+	if c.ContentType() == "application/json" {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		if err := json.Unmarshal(body, &ids); err != nil {
+			var wrapped struct {
+				IDs []uint `json:"ids"`
+			}
+			if err := json.Unmarshal(body, &wrapped); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Expected a JSON array of credential IDs"})
+				return
+			}
+			ids = wrapped.IDs
+		}
+	} else {
+		// net/http only parses form bodies for POST/PUT/PATCH, so decode it here
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request body"})
+			return
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form body"})
+			return
+		}
+		for _, idStr := range append(form["ids"], c.QueryArray("ids")...) {
+			id, err := strconv.ParseUint(idStr, 10, 32)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID: " + idStr})
+				return
+			}
+			ids = append(ids, uint(id))
+		}
+	}
+
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No credential IDs given"})
+		return
+	}
+
+	deleted, err := db.DeleteCredentials(ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete credentials: " + err.Error()})
+		return
+	}
+
+	for _, id := range deleted {
+		recordAudit(c, "credential.delete", strconv.FormatUint(uint64(id), 10))
+	}
+
+	// Reload credentials
+	ReloadCredentials()
+
+	c.JSON(http.StatusOK, gin.H{
+		"deleted": len(deleted),
+		"skipped": len(ids) - len(deleted),
+	})
+}
+
+// RevealCredential returns the full token of a credential as JSON
+func RevealCredential(c *gin.Context) {
+	idStr := c.Param("id")
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid ID"})
+		return
+	}
+
+	credential, err := db.GetCredentialByID(uint(id))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Credential not found"})
+		return
+	}
+
+	recordAudit(c, "credential.reveal", idStr)
+	c.JSON(http.StatusOK, gin.H{"token": credential.Token})
+}
+
 // ReloadCredentialsHandler reloads credentials
 func ReloadCredentialsHandler(c *gin.Context) {
 	ReloadCredentials()
+	recordAudit(c, "credential.reload", "")
 	c.Redirect(http.StatusFound, "/admin/credentials")
 }
 
@@ -268,9 +856,26 @@ func GenerateAPITokenHandler(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "apitoken.generate", "")
+
 	c.Redirect(http.StatusFound, "/admin/credentials")
 }
 
+// SetAPITokenModelsHandler restricts the API token to a comma-separated list of models; empty allows all
+func SetAPITokenModelsHandler(c *gin.Context) {
+	models := normalizeModelList(c.PostForm("models"))
+	if err := db.SetAPITokenModels(models); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to update API token models: " + err.Error(),
+		})
+		return
+	}
+
+	recordAudit(c, "apitoken.models", models)
+
+	c.Redirect(http.StatusFound, "/admin/credentials#api-token")
+}
+
 // ShowChangePasswordPage displays the change password page
 func ShowChangePasswordPage(c *gin.Context) {
 	// Check if it's the initial password
@@ -334,8 +939,10 @@ func ChangePassword(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "password.change", "")
+
 	// Clear JWT cookie, force re-login
-	c.SetCookie("admin_jwt", "", -1, "/", "", false, true)
+	clearAdminCookie(c)
 
 	// Redirect to login page
 	c.Redirect(http.StatusFound, "/admin/login?message=Password updated, please login again")
@@ -363,8 +970,10 @@ func ResetPassword(c *gin.Context) {
 		return
 	}
 
+	recordAudit(c, "password.reset", "")
+
 	// Clear JWT cookie, force re-login
-	c.SetCookie("admin_jwt", "", -1, "/", "", false, true)
+	clearAdminCookie(c)
 
 	// Show new password
 	c.HTML(http.StatusOK, "password_reset_success.html", gin.H{
@@ -373,104 +982,864 @@ func ResetPassword(c *gin.Context) {
 	})
 }
 
-// ListModels handles GET /v1/models
-func ListModels(c *gin.Context) {
-	now := time.Now().Unix()
-
-	models := make([]Model, len(SupportedModels))
-	for i, modelID := range SupportedModels {
-		models[i] = Model{
-			ID:      modelID,
-			Object:  "model",
-			Created: now,
-			OwnedBy: "system",
-		}
-	}
-
-	response := ModelsResponse{
-		Object: "list",
-		Data:   models,
-	}
-
-	c.JSON(http.StatusOK, response)
-}
+// jwtSecretSource names where the active HS256 secret came from: "JWT_SECRET",
+// "database" (a runtime rotation) or "default"
+var jwtSecretSource = "JWT_SECRET"
 
-// ChatCompletions handles POST /v1/chat/completions
-func ChatCompletions(c *gin.Context) {
-	// Validate API token
-	authHeader := c.GetHeader("Authorization")
-	if authHeader == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key is required"})
+// RotateSecret replaces the JWT signing secret, ending every admin session.
+// With JWT_ROTATION_GRACE set, other sessions stay valid for that long; the
+// caller's own session always ends right away.
+func RotateSecret(c *gin.Context) {
+	if auth.Algorithm() != "HS256" {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"error": auth.ErrRotationUnsupported.Error(),
+		})
 		return
 	}
 
-	// Extract token
-	tokenParts := strings.Split(authHeader, " ")
-	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key format"})
+	secret, err := auth.GenerateSecret()
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to generate secret: " + err.Error(),
+		})
 		return
 	}
 
-	apiToken := tokenParts[1]
-	if !db.ValidateAPIToken(apiToken) {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+	// Persist first so the rotation survives a restart
+	if err := db.SetJWTSecret(secret); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to save secret: " + err.Error(),
+		})
 		return
 	}
+	if err := auth.SetSecret(secret, JWTRotationGrace); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to rotate secret: " + err.Error(),
+		})
+		return
+	}
+	jwtSecretSource = "database"
+	if os.Getenv("JWT_SECRET") != "" {
+		log.Printf("JWT secret rotated; JWT_SECRET is set and will take precedence again after a restart")
+	}
 
-	var req ChatCompletionRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request format"})
+	recordAudit(c, "jwt.rotate", "")
+
+	// Clear JWT cookie, force re-login
+	clearAdminCookie(c)
+	c.Redirect(http.StatusFound, "/admin/login")
+}
+
+// extractAPIToken reads the API key from the Authorization bearer header,
+// falling back to x-api-key. It returns an error message if neither is usable.
+func extractAPIToken(c *gin.Context) (string, string) {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" {
+		if apiKey := c.GetHeader("x-api-key"); apiKey != "" {
+			return apiKey, ""
+		}
+		return "", "API key is required"
+	}
+
+	tokenParts := strings.Split(authHeader, " ")
+	if len(tokenParts) != 2 || tokenParts[0] != "Bearer" {
+		return "", "Invalid API key format"
+	}
+	return tokenParts[1], ""
+}
+
+// modelsCache holds the last built /v1/models response, keyed by the model list it was built from
+var modelsCache struct {
+	sync.Mutex
+	key      string
+	response *ModelsResponse
+}
+
+// getModelsResponse returns the cached models response, rebuilding it when the model list changes
+func getModelsResponse() ModelsResponse {
+	enabled := EnabledModels()
+	key := strings.Join(enabled, "\n")
+
+	modelsCache.Lock()
+	defer modelsCache.Unlock()
+
+	if modelsCache.response != nil && modelsCache.key == key {
+		return *modelsCache.response
+	}
+
+	now := time.Now().Unix()
+
+	models := make([]Model, len(enabled))
+	for i, modelID := range enabled {
+		models[i] = Model{
+			ID:      modelID,
+			Object:  "model",
+			Created: now,
+			OwnedBy: modelOwner(modelID),
+		}
+		if info, ok := ModelMetadata[modelID]; ok {
+			capabilities := info.Capabilities
+			models[i].ContextWindow = info.ContextWindow
+			models[i].MaxOutputTokens = info.MaxOutputTokens
+			models[i].Capabilities = &capabilities
+		}
+	}
+
+	modelsCache.key = key
+	modelsCache.response = &ModelsResponse{
+		Object: "list",
+		Data:   models,
+	}
+	return *modelsCache.response
+}
+
+// ShowAuditPage displays the most recent audit log entries
+func ShowAuditPage(c *gin.Context) {
+	const pageSize = 50
+
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	entries, total, err := db.GetAuditLogs(page, pageSize)
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to get audit log: " + err.Error(),
+		})
 		return
 	}
 
-	// Validate required fields
-	if req.Model == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Model is required"})
+	c.HTML(http.StatusOK, "audit.html", gin.H{
+		"title":    "Audit Log",
+		"entries":  entries,
+		"total":    total,
+		"page":     page,
+		"prevPage": page - 1,
+		"nextPage": page + 1,
+		"hasNext":  int64(page*pageSize) < total,
+	})
+}
+
+// ShowModelsPage lists the supported models and whether each is disabled
+func ShowModelsPage(c *gin.Context) {
+	type modelRow struct {
+		ID       string
+		Disabled bool
+	}
+	rows := make([]modelRow, len(SupportedModels))
+	for i, m := range SupportedModels {
+		rows[i] = modelRow{ID: m, Disabled: IsModelDisabled(m)}
+	}
+
+	c.HTML(http.StatusOK, "models.html", gin.H{
+		"title":  "Models",
+		"models": rows,
+	})
+}
+
+// ToggleModel disables or re-enables a supported model
+func ToggleModel(c *gin.Context) {
+	modelID := c.PostForm("model")
+	disabled := c.PostForm("disabled") == "true"
+
+	if !slices.Contains(SupportedModels, modelID) {
+		c.HTML(http.StatusBadRequest, "error.html", gin.H{
+			"error": "Unknown model: " + modelID,
+		})
 		return
 	}
 
-	if len(req.Messages) == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Messages are required"})
+	if err := db.SetModelDisabled(modelID, disabled); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to update model: " + err.Error(),
+		})
+		return
+	}
+
+	if disabled {
+		recordAudit(c, "model.disable", modelID)
+	} else {
+		recordAudit(c, "model.enable", modelID)
+	}
+
+	LoadDisabledModels()
+
+	c.Redirect(http.StatusFound, "/admin/models")
+}
+
+// ShowUsagePage displays per-token usage aggregated by day
+func ShowUsagePage(c *gin.Context) {
+	days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+	if err != nil || days < 1 {
+		days = 30
+	}
+
+	summaries, err := db.GetDailyUsage(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to get usage: " + err.Error(),
+		})
 		return
 	}
 
-	request := req.ToOpenAIRequest()
+	c.HTML(http.StatusOK, "usage.html", gin.H{
+		"title":     "Usage",
+		"summaries": summaries,
+		"days":      days,
+	})
+}
+
+// CredentialStatus describes the health of one credential on the status page
+type CredentialStatus struct {
+	Email       string    `json:"email"`
+	Token       string    `json:"token"`
+	Models      []string  `json:"models,omitempty"`
+	Enabled     bool      `json:"enabled"`
+	Successes   int64     `json:"successes"`
+	Failures    int64     `json:"failures"`
+	LastStatus  int       `json:"last_status,omitempty"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastUsedAt  time.Time `json:"last_used_at,omitempty"`
+	LastFailure time.Time `json:"last_failure,omitempty"`
+	Healthy     bool      `json:"healthy"`
+
+	// Quota from the gateway's rate-limit headers, when it sends them
+	RateLimitRemaining *int      `json:"rate_limit_remaining,omitempty"`
+	RateLimitReset     time.Time `json:"rate_limit_reset,omitempty"`
+	RateLimitedUntil   time.Time `json:"rate_limited_until,omitempty"`
+}
+
+// ShowConfig returns the configuration the process resolved from its environment,
+// with tokens and passwords masked
+func ShowConfig(c *gin.Context) {
+	loaded := loadedCredentials()
+	credentials := make([]gin.H, len(loaded))
+	for i, cred := range loaded {
+		credentials[i] = gin.H{
+			"email":           cred.Email,
+			"token":           maskToken(cred.Token),
+			"models":          cred.Models,
+			"read_only":       cred.ReadOnly,
+			"max_concurrency": cred.concurrencyLimit(),
+			"weight":          cred.Weight,
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"upstream": gin.H{
+			"endpoint":                AtlassianAPIEndpoint,
+			"proxy":                   maskURL(UpstreamProxy),
+			"max_idle_conns_per_host": UpstreamMaxIdleConnsPerHost,
+			"idle_conn_timeout":       UpstreamIdleConnTimeout.String(),
+			"health_timeout":          UpstreamHealthTimeout.String(),
+			"health_cache_ttl":        UpstreamHealthCacheTTL.String(),
+		},
+		"retry": gin.H{
+			"credential_strategy":  CredentialStrategy,
+			"max_retries":          MaxRetries,
+			"budget":               RetryBudget.String(),
+			"default_min_attempts": DefaultMinAttempts,
+			"initial_delay":        InitialDelay.String(),
+			"max_delay":            MaxDelay.String(),
+			"delay_multiplier":     DelayMultiplier,
+		},
+		"timeouts": gin.H{
+			"request":                 RequestTimeout.String(),
+			"request_min":             RequestTimeoutMin.String(),
+			"request_max":             RequestTimeoutMax.String(),
+			"concurrency_wait":        ConcurrencyWaitTimeout.String(),
+			"credential_queue":        CredentialQueueTimeout.String(),
+			"stream_first_byte":       StreamFirstByteTimeout.String(),
+			"stream_idle":             StreamIdleTimeout.String(),
+			"stream_max_duration":     StreamMaxDuration.String(),
+			"stream_keepalive":        StreamKeepaliveInterval.String(),
+			"credential_health_check": CredentialHealthCheckInterval.String(),
+			"idempotency_ttl":         IdempotencyTTL.String(),
+		},
+		"limits": gin.H{
+			"max_concurrent_requests":    MaxConcurrentRequests,
+			"credential_max_concurrency": CredentialMaxConcurrency,
+			"credential_queue_depth":     CredentialQueueDepth,
+			"max_credentials":            MaxCredentials,
+			"max_request_body_size":      MaxRequestBodySize,
+			"max_sse_frame_size":         MaxSSEFrameSize,
+			"max_messages":               MaxMessages,
+			"max_prompt_chars":           MaxPromptChars,
+		},
+		"cors": gin.H{
+			"allow_origins": []string{"*"},
+		},
+		"models": gin.H{
+			"supported":      SupportedModels,
+			"enabled":        EnabledModels(),
+			"default":        DefaultModel,
+			"fallbacks":      ModelFallbacks,
+			"response_names": ResponseModelNames,
+			"owners":         ModelOwners,
+		},
+		"features": gin.H{
+			"debug":              DebugMode,
+			"context_preflight":  ContextPreflight,
+			"retry_empty":        RetryEmptyResponse,
+			"stream_decode":      StreamDecodeResponses,
+			"credential_index":   CredentialIndexHeader,
+			"admin_basic_auth":   AdminBasicAuth,
+			"cookie_name":        CookieName,
+			"cookie_path":        CookiePath,
+			"reasoning_tag_mode": ReasoningTagMode,
+			"reasoning_tag":      ReasoningTag,
+			"system_prompt":      SystemPrompt != "",
+			"system_prompt_mode": SystemPromptMode,
+			"debug_record_dir":   DebugRecordDir,
+		},
+		"auth": gin.H{
+			"jwt_algorithm": auth.Algorithm(),
+			"jwt_secret":    maskSecret(os.Getenv("JWT_SECRET")),
+			"jwt_source":    jwtSecretSource,
+			"jwt_grace":     JWTRotationGrace.String(),
+		},
+		"database": gin.H{
+			"url": maskURL(os.Getenv("DATABASE_URL")),
+		},
+		"credentials": credentials,
+	})
+}
+
+// maskSecret hides a configured secret entirely, keeping only whether it is set
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return "********"
+}
+
+// maskURL hides the password in a URL; values that don't parse as a URL are masked entirely
+func maskURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return maskSecret(raw)
+	}
+	return u.Redacted()
+}
+
+// ShowLogsPage shows the most recent server log lines as HTML or JSON (?format=json).
+// ?lines=N limits the number of lines returned.
+func ShowLogsPage(c *gin.Context) {
+	n, err := strconv.Atoi(c.DefaultQuery("lines", "500"))
+	if err != nil || n < 0 {
+		n = 500
+	}
+
+	var lines []logLine
+	if LogBufferLines > 0 {
+		lines = recentLogs.Recent(n)
+	}
+	if lines == nil {
+		lines = []logLine{}
+	}
+
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, gin.H{"lines": lines})
+		return
+	}
+
+	c.HTML(http.StatusOK, "logs.html", gin.H{
+		"title":   "Logs",
+		"lines":   lines,
+		"enabled": LogBufferLines > 0,
+	})
+}
+
+// StreamLogs sends new log lines as server-sent events until the client disconnects
+func StreamLogs(c *gin.Context) {
+	if LogBufferLines <= 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Log buffer is disabled"})
+		return
+	}
+	if !canFlush(c.Writer) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
+		return
+	}
+
+	lines, unsubscribe := recentLogs.Subscribe()
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	// A nil channel never fires, leaving keepalives off
+	var keepalive <-chan time.Time
+	if StreamKeepaliveInterval > 0 {
+		ticker := time.NewTicker(StreamKeepaliveInterval)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case line := <-lines:
+			data, err := json.Marshal(line)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(c.Writer, "data: %s\n\n", data); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-keepalive:
+			if _, err := fmt.Fprint(c.Writer, ": keepalive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+// UsageAPI returns requests and token totals per model per day as JSON.
+// The optional from/to query parameters are inclusive dates (YYYY-MM-DD) and
+// default to the last 30 days.
+func UsageAPI(c *gin.Context) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -29)
+	var to time.Time
+
+	if v := c.Query("from"); v != "" {
+		day, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			openAIParamError(c, "from", "from must be a date in YYYY-MM-DD format")
+			return
+		}
+		from = day
+	}
+	if v := c.Query("to"); v != "" {
+		day, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			openAIParamError(c, "to", "to must be a date in YYYY-MM-DD format")
+			return
+		}
+		to = day.AddDate(0, 0, 1)
+		if !to.After(from) {
+			openAIParamError(c, "to", "to must not be before from")
+			return
+		}
+	}
+
+	summaries, err := db.GetModelUsage(from, to)
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", "Failed to get usage: "+err.Error())
+		return
+	}
+	if summaries == nil {
+		summaries = []db.ModelUsageSummary{}
+	}
+
+	data := gin.H{
+		"from": from.Format(time.DateOnly),
+		"data": summaries,
+	}
+	if !to.IsZero() {
+		data["to"] = to.AddDate(0, 0, -1).Format(time.DateOnly)
+	}
+	c.JSON(http.StatusOK, data)
+}
+
+// ShowStatusPage reports per-credential health and the rotation cursor as HTML or JSON (?format=json)
+func ShowStatusPage(c *gin.Context) {
+	credentials := loadedCredentials()
+	statuses := make([]CredentialStatus, len(credentials))
+	for i, cred := range credentials {
+		stats := getCredentialStats(cred.Email)
+		statuses[i] = CredentialStatus{
+			Email:       cred.Email,
+			Token:       maskToken(cred.Token),
+			Models:      cred.Models,
+			Enabled:     true,
+			Successes:   stats.Successes,
+			Failures:    stats.Failures,
+			LastStatus:  stats.LastStatus,
+			LastError:   stats.LastError,
+			LastUsedAt:  stats.LastUsedAt,
+			LastFailure: stats.LastFailure,
+			Healthy:     !stats.Unhealthy,
+
+			RateLimitRemaining: stats.RateLimitRemaining,
+			RateLimitReset:     stats.RateLimitReset,
+			RateLimitedUntil:   stats.RateLimitedUntil,
+		}
+	}
+
+	data := gin.H{
+		"credentials":     statuses,
+		"rotation_cursor": rotationCursor.Load(),
+	}
+
+	if c.Query("format") == "json" {
+		c.JSON(http.StatusOK, data)
+		return
+	}
+
+	data["title"] = "Status"
+	c.HTML(http.StatusOK, "status.html", data)
+}
+
+// ListModels handles GET /v1/models
+func ListModels(c *gin.Context) {
+	c.JSON(http.StatusOK, getModelsResponse())
+}
+
+// RetrieveModel handles GET /v1/models/:model, matching IDs with or without vendor prefix
+func RetrieveModel(c *gin.Context) {
+	modelID := c.Param("model")
+	for _, model := range getModelsResponse().Data {
+		if model.ID == modelID || TransformModelID(model.ID) == TransformModelID(modelID) {
+			c.JSON(http.StatusOK, model)
+			return
+		}
+	}
+
+	openAIError(c, http.StatusNotFound, "invalid_request_error",
+		fmt.Sprintf("The model '%s' does not exist", modelID))
+}
+
+// buildAtlassianRequest applies the configured system prompt to req and maps it
+// to the gateway's format, dropping parameters the model doesn't support. On
+// failure it also returns the offending request parameter.
+func buildAtlassianRequest(req *ChatCompletionRequest) (AtlassianRequest, string, error) {
+	stop, err := normalizeStop(req.Stop)
+	if err != nil {
+		return AtlassianRequest{}, "stop", err
+	}
+
+	req.Messages = applySystemPrompt(req.Messages)
+
+	request, err := req.ToOpenAIRequest()
+	if err != nil {
+		return AtlassianRequest{}, "messages", err
+	}
 
-	// Create Atlassian request
 	atlassianReq := AtlassianRequest{
 		RequestPayload: AtlassianRequestPayload{
-			Messages:    request.Messages,
-			Temperature: req.Temperature,
-			Stream:      req.Stream,
+			Messages:       request.Messages,
+			Temperature:    req.Temperature,
+			TopP:           req.TopP,
+			MaxTokens:      req.MaxTokens,
+			Stream:         req.Stream,
+			ResponseFormat: request.ResponseFormat,
+			Stop:           stop,
+			LogitBias:      req.LogitBias,
+			Tools:          req.Tools,
 		},
 		PlatformAttributes: AtlassianPlatformAttrs{
 			Model: TransformModelID(req.Model),
 		},
 	}
+	filterUnsupportedParams(&atlassianReq.RequestPayload, req.Model)
+	return atlassianReq, "", nil
+}
+
+// ChatCompletions handles POST /v1/chat/completions
+func ChatCompletions(c *gin.Context) {
+	start := time.Now()
+
+	// Validate API token
+	apiToken, errMsg := extractAPIToken(c)
+	if errMsg != "" {
+		openAIError(c, http.StatusUnauthorized, "authentication_error", errMsg)
+		return
+	}
 
-	// Create HTTP client
-	client := NewHTTPClient()
+	if !db.ValidateAPIToken(apiToken) {
+		openAIError(c, http.StatusUnauthorized, "authentication_error", "Invalid API key")
+		return
+	}
+
+	var req ChatCompletionRequest
+	var usage ChatCompletionUsage
+	// Dry runs and idempotent replays never reach the gateway and are not logged
+	logRequest := true
+	defer func() {
+		if logRequest {
+			recordRequestLog(apiToken, req.Model, req.Metadata, usage, c.Writer.Status())
+		}
+	}()
+
+	if err := decodeJSONBody(c.Request.Body, &req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			openAIError(c, http.StatusRequestEntityTooLarge, "invalid_request_error",
+				fmt.Sprintf("Request body exceeds the limit of %d bytes", maxBytesErr.Limit))
+			return
+		}
+		param, msg := describeJSONError(err)
+		if param == "" {
+			openAIError(c, http.StatusBadRequest, "invalid_request_error", msg)
+			return
+		}
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	// Validate required fields
+	if req.Model == "" {
+		req.Model = DefaultModel
+	}
+	if req.Model == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Model is required"})
+		return
+	}
+	if IsModelDisabled(req.Model) {
+		openAIParamError(c, "model", fmt.Sprintf("The model '%s' is currently disabled", req.Model))
+		return
+	}
+
+	// The API token may be restricted to some models
+	tokenModels, err := db.APITokenModels(apiToken)
+	if err != nil {
+		openAIError(c, http.StatusInternalServerError, "server_error", "Failed to load API key permissions")
+		return
+	}
+	allowedModels := splitModelList(tokenModels)
+	if !modelAllowed(allowedModels, req.Model) {
+		openAIError(c, http.StatusForbidden, "permission_error",
+			fmt.Sprintf("This API key is not allowed to use the model '%s'", req.Model))
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Messages are required"})
+		return
+	}
+
+	if param, msg := validateSamplingParams(&req); param != "" {
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	if param, msg := validateMessageRoles(req.Messages); param != "" {
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	if param, msg := validateConversationLimits(req.Messages); param != "" {
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	if param, msg := validateTools(req.Tools); param != "" {
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	if param, msg := validateMetadata(req.Metadata); param != "" {
+		openAIParamError(c, param, msg)
+		return
+	}
+
+	atlassianReq, param, err := buildAtlassianRequest(&req)
+	if err != nil {
+		openAIParamError(c, param, err.Error())
+		return
+	}
+
+	// Optional pre-flight: fail fast instead of waiting for the gateway's error
+	if ContextPreflight {
+		if info, ok := lookupModelInfo(req.Model); ok && info.ContextWindow > 0 {
+			if estimated := estimatePromptTokens(atlassianReq.RequestPayload.Messages); estimated > info.ContextWindow {
+				c.JSON(http.StatusBadRequest, gin.H{
+					"error": gin.H{
+						"message": fmt.Sprintf("This model's maximum context length is %d tokens, but the messages are estimated at over %d tokens", info.ContextWindow, estimated),
+						"type":    "invalid_request_error",
+						"param":   "messages",
+						"code":    "context_length_exceeded",
+					},
+				})
+				return
+			}
+		}
+	}
+
+	if DebugMode {
+		log.Printf("Forwarding model=%s %s", atlassianReq.PlatformAttributes.Model,
+			describeForwardedParams(atlassianReq.RequestPayload))
+	}
+
+	// Dry run: return the would-be upstream payload without calling the gateway
+	if req.DryRun || c.GetHeader("X-Dry-Run") == "true" {
+		logRequest = false
+		c.JSON(http.StatusOK, atlassianReq)
+		return
+	}
+
+	// Replay a cached response for a repeated Idempotency-Key (non-streaming only)
+	var idempotencyKey string
+	if key := c.GetHeader("Idempotency-Key"); key != "" && !req.Stream {
+		idempotencyKey = idempotencyCacheKey(apiToken, key)
+		if cached, ok := getIdempotentResponse(idempotencyKey); ok {
+			logRequest = false
+			c.Header("Idempotent-Replayed", "true")
+			c.JSON(http.StatusOK, cached)
+			return
+		}
+	}
+
+	// Shared HTTP client, reusing upstream connections
+	client := SharedHTTPClient()
 	ctx := c.Request.Context()
 
-	// Make request with retry
-	resp, err := client.FetchWithRetry(ctx, atlassianReq, req.Stream)
+	// Non-streaming requests honor the configured deadline or an X-Request-Timeout override
+	if !req.Stream {
+		if timeout := requestTimeout(c.GetHeader("X-Request-Timeout")); timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+	}
+
+	// Wait for a free upstream slot; it is held until the response or stream completes
+	release, ok := AcquireUpstreamSlot(ctx)
+	if !ok {
+		c.Header("Retry-After", strconv.Itoa(max(int(ConcurrencyWaitTimeout.Seconds()), 1)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many concurrent requests"})
+		return
+	}
+	defer release()
+
+	// Make request with retry. Streams, and optionally large completions, are
+	// read from the unbuffered body.
+	ctx, trace := withUpstreamTrace(ctx)
+	responseModel := req.Model
+	rawBody := req.Stream || (StreamDecodeResponses && !RetryEmptyResponse)
+	fetchStart := time.Now()
+	resp, err := client.FetchWithRetry(ctx, atlassianReq, rawBody)
+
+	// On upstream server failure, retry once with the configured fallback model
+	if errors.Is(err, ErrUpstreamUnavailable) {
+		if fallback, ok := ModelFallbacks[TransformModelID(req.Model)]; ok && !IsModelDisabled(fallback) && modelAllowed(allowedModels, fallback) {
+			log.Printf("Model %s unavailable, falling back to %s", req.Model, fallback)
+			atlassianReq.PlatformAttributes.Model = TransformModelID(fallback)
+			filterUnsupportedParams(&atlassianReq.RequestPayload, fallback)
+			responseModel = fallback
+			resp, err = client.FetchWithRetry(ctx, atlassianReq, rawBody)
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		openAIError(c, http.StatusGatewayTimeout, "timeout_error", "Request timed out waiting for the upstream")
+		return
+	}
+	if errors.Is(err, ErrCredentialsBusy) {
+		c.Header("Retry-After", strconv.Itoa(max(int(CredentialQueueTimeout.Seconds()), 1)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "All credentials are busy"})
+		return
+	}
 	if err != nil {
+		// A rejected stream still holds its connection and credential slot
+		if resp != nil && rawBody {
+			resp.RawBody().Close()
+		}
 		c.JSON(http.StatusBadGateway, gin.H{"error": "All credentials exhausted"})
 		return
 	}
+	setUpstreamHeaders(c, time.Since(fetchStart), trace)
+
+	// A client that requested a stream but only accepts JSON, or whose connection
+	// can't be flushed incrementally, gets the stream aggregated
+	if req.Stream {
+		flushable := canFlush(c.Writer)
+		if !flushable {
+			log.Printf("Response writer doesn't support flushing, returning the stream as a single response")
+		}
+		if !flushable || acceptsOnlyJSON(c) {
+			openaiResp := handleAggregatedStreamResponse(c, resp, responseModel)
+			if openaiResp != nil {
+				usage = openaiResp.Usage
+			}
+			return
+		}
+	}
 
 	// Handle streaming response
 	if req.Stream {
-		handleStreamingResponse(c, resp, req.Model)
+		includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+		usage = handleStreamingResponse(c, resp, responseModel, includeUsage, start)
 		return
 	}
 
+	// Optionally regenerate once when the upstream answered with no content at all
+	if RetryEmptyResponse && isEmptyCompletion(resp.Body()) {
+		log.Printf("Empty completion from upstream for model %s, retrying once", responseModel)
+		retryStart := time.Now()
+		retryResp, err := client.FetchWithRetry(ctx, atlassianReq, false)
+		if err == nil {
+			resp = retryResp
+			setUpstreamHeaders(c, time.Since(retryStart), trace)
+		} else {
+			log.Printf("Retry after empty completion failed, returning the empty one: %v", err)
+		}
+	}
+
 	// Handle non-streaming response
-	handleNonStreamingResponse(c, resp, req.Model)
+	var openaiResp *ChatCompletionResponse
+	if rawBody {
+		openaiResp = handleDecodedResponse(c, resp, responseModel, req.StructuredContent)
+	} else {
+		openaiResp = handleNonStreamingResponse(c, resp, responseModel, req.StructuredContent)
+	}
+	if openaiResp == nil {
+		return
+	}
+	usage = openaiResp.Usage
+	if idempotencyKey != "" {
+		storeIdempotentResponse(idempotencyKey, *openaiResp)
+	}
+}
+
+// requestTimeout resolves the deadline for a non-streaming request. A valid
+// X-Request-Timeout value (seconds) is clamped to the configured bounds;
+// a missing or invalid one falls back to REQUEST_TIMEOUT.
+func requestTimeout(header string) time.Duration {
+	seconds, err := strconv.ParseFloat(strings.TrimSpace(header), 64)
+	if err != nil || seconds <= 0 || math.IsInf(seconds, 0) || math.IsNaN(seconds) {
+		return RequestTimeout
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout < RequestTimeoutMin {
+		return RequestTimeoutMin
+	}
+	if timeout > RequestTimeoutMax {
+		return RequestTimeoutMax
+	}
+	return timeout
+}
+
+// errStreamMaxDuration is reported when a stream exceeds STREAM_MAX_DURATION
+var errStreamMaxDuration = errors.New("stream exceeded maximum duration")
+
+// setUpstreamHeaders reports how long the upstream took to respond, and with
+// CREDENTIAL_INDEX_HEADER which credential answered. For streams the latency is
+// the time until the response headers arrived.
+func setUpstreamHeaders(c *gin.Context, latency time.Duration, trace *upstreamTrace) {
+	c.Header("X-Upstream-Latency-Ms", strconv.FormatInt(latency.Milliseconds(), 10))
+	if CredentialIndexHeader && trace.credentialIndex >= 0 {
+		c.Header("X-Credential-Index", strconv.Itoa(trace.credentialIndex))
+	}
 }
 
-// handleStreamingResponse processes streaming chat completion
-func handleStreamingResponse(c *gin.Context, resp *resty.Response, requestedModel string) {
+// handleStreamingResponse processes streaming chat completion and returns the usage reported upstream.
+// start is when the request was received, used for the latency metrics.
+func handleStreamingResponse(c *gin.Context, resp *resty.Response, requestedModel string, includeUsage bool, start time.Time) ChatCompletionUsage {
+	defer func() {
+		streamDuration.Observe(time.Since(start).Seconds())
+	}()
+
 	// Set streaming headers
 	c.Header("Content-Type", "text/event-stream")
 	c.Header("Cache-Control", "no-cache")
@@ -478,11 +1847,19 @@ func handleStreamingResponse(c *gin.Context, resp *resty.Response, requestedMode
 
 	// Create stream response
 	streamResp := &StreamResponse{
-		Response: resp,
-		Model:    requestedModel,
+		Response:     resp,
+		Model:        requestedModel,
+		IncludeUsage: includeUsage,
 	}
 
-	ctx := c.Request.Context()
+	// Optionally cap the total stream duration; the idle timeout still applies to gaps.
+	// Cancelling ctx also stops the upstream read, e.g. once the client is gone.
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	if StreamMaxDuration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, StreamMaxDuration)
+		defer cancel()
+	}
 	dataChan, errChan := streamResp.ConvertToOpenAIStream(ctx)
 
 	// Stream data to client
@@ -493,38 +1870,339 @@ func handleStreamingResponse(c *gin.Context, resp *resty.Response, requestedMode
 	flusher, ok := c.Writer.(http.Flusher)
 	if !ok {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Streaming not supported"})
-		return
+		return ChatCompletionUsage{}
 	}
 
+	// Send a byte right away so intermediaries that expect an early response
+	// don't drop the connection while the model works on its first token.
+	// SSE clients ignore comment lines.
+	if _, err := c.Writer.Write([]byte(": connected\n\n")); err != nil {
+		return ChatCompletionUsage{}
+	}
+	flusher.Flush()
+
+	// Send an SSE comment when nothing has been forwarded for a while so that
+	// intermediaries don't drop the idle connection. With keepalives off the
+	// timer channel stays nil and never fires.
+	var keepalive *time.Timer
+	var keepaliveC <-chan time.Time
+	if StreamKeepaliveInterval > 0 {
+		keepalive = time.NewTimer(StreamKeepaliveInterval)
+		defer keepalive.Stop()
+		keepaliveC = keepalive.C
+	}
+	resetKeepalive := func() {
+		if keepalive != nil {
+			keepalive.Reset(StreamKeepaliveInterval)
+		}
+	}
+
+	firstChunk := true
 	for {
 		select {
 		case data, ok := <-dataChan:
 			if !ok {
-				return
+				// errChan closes first, so an error the conversion ended with is already waiting
+				if err := <-errChan; err != nil && err != context.Canceled {
+					if err == context.DeadlineExceeded {
+						err = errStreamMaxDuration
+					}
+					writeStreamError(c.Writer, err)
+					flusher.Flush()
+				}
+				return streamResp.Usage()
+			}
+			if firstChunk {
+				firstChunk = false
+				ttft := time.Since(start)
+				streamTimeToFirstToken.Observe(ttft.Seconds())
+				if DebugMode {
+					log.Printf("Time to first token for %s: %v", requestedModel, ttft)
+				}
+			}
+			if _, err := c.Writer.Write(data); err != nil {
+				// Client went away; stop pulling from the upstream
+				return streamResp.Usage()
+			}
+			flusher.Flush()
+			resetKeepalive()
+		case <-keepaliveC:
+			if _, err := c.Writer.Write([]byte(": keepalive\n\n")); err != nil {
+				return streamResp.Usage()
 			}
-			c.Writer.Write(data)
 			flusher.Flush()
+			resetKeepalive()
 		case err := <-errChan:
+			// Both channels close when the conversion ends, so chunks may still
+			// be buffered; forward them before the error or the end of stream
+			for data := range dataChan {
+				if _, err := c.Writer.Write(data); err != nil {
+					break
+				}
+			}
+			if err == context.DeadlineExceeded {
+				err = errStreamMaxDuration
+			}
 			if err != nil && err != context.Canceled {
-				c.Writer.Write([]byte("data: {\"error\":\"" + err.Error() + "\"}\n\n"))
+				writeStreamError(c.Writer, err)
 				flusher.Flush()
 			}
-			return
+			return streamResp.Usage()
 		case <-ctx.Done():
-			return
+			if ctx.Err() == context.DeadlineExceeded {
+				writeStreamError(c.Writer, errStreamMaxDuration)
+				flusher.Flush()
+			}
+			return streamResp.Usage()
+		}
+	}
+}
+
+// writeStreamError writes an OpenAI-shaped SSE error event followed by [DONE]
+// so clients terminate the stream cleanly
+func writeStreamError(w io.Writer, err error) {
+	payload, _ := json.Marshal(gin.H{
+		"error": gin.H{
+			"message": err.Error(),
+			"type":    "upstream_error",
+		},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", payload)
+	io.WriteString(w, "data: [DONE]\n\n")
+}
+
+// canFlush reports whether w, and every writer it wraps, supports http.Flusher.
+// gin's writer always has a Flush method but panics if the one beneath it doesn't.
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		if _, ok := w.(http.Flusher); !ok {
+			return false
+		}
+		wrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return true
+		}
+		w = wrapper.Unwrap()
+	}
+}
+
+// acceptsOnlyJSON reports whether the Accept header asks for JSON and not SSE
+func acceptsOnlyJSON(c *gin.Context) bool {
+	accept := c.GetHeader("Accept")
+	return strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/event-stream")
+}
+
+// handleAggregatedStreamResponse consumes an upstream stream and replies with a
+// single non-streaming chat completion. It returns the response sent, or nil if it failed.
+func handleAggregatedStreamResponse(c *gin.Context, resp *resty.Response, requestedModel string) *ChatCompletionResponse {
+	streamResp := &StreamResponse{
+		Response: resp,
+		Model:    requestedModel,
+	}
+
+	ctx := c.Request.Context()
+	if StreamMaxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, StreamMaxDuration)
+		defer cancel()
+	}
+	dataChan, errChan := streamResp.ConvertToOpenAIStream(ctx)
+
+	aggregator := newStreamAggregator()
+	for data := range dataChan {
+		payload := strings.TrimSpace(strings.TrimPrefix(string(data), "data:"))
+		if payload == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		aggregator.add(chunk)
+	}
+
+	if err := <-errChan; err != nil {
+		if err == context.DeadlineExceeded {
+			err = errStreamMaxDuration
+		}
+		openAIError(c, http.StatusBadGateway, "upstream_error", err.Error())
+		return nil
+	}
+
+	openaiResp := aggregator.response(requestedModel, streamResp.Usage())
+	c.JSON(http.StatusOK, openaiResp)
+	return &openaiResp
+}
+
+var (
+	htmlTagPattern     = regexp.MustCompile(`(?s)<script.*?</script>|<style.*?</style>|<[^>]*>`)
+	secretLikePattern  = regexp.MustCompile(`[A-Za-z0-9_\-=+/]{32,}`)
+	whitespacePattern  = regexp.MustCompile(`\s+`)
+	maxUpstreamSnippet = 200
+)
+
+// upstreamErrorStatus picks the HTTP status and OpenAI error type for an error
+// embedded in an upstream response. The status the gateway states wins; without
+// one the error type is used, and anything unrecognized is a 502. Auth failures
+// concern the proxy's credentials rather than the client's key, so they are 502s too.
+func upstreamErrorStatus(e *AtlassianError) (int, string) {
+	status := e.Status
+	if status < 400 || status > 599 {
+		errType := strings.ToLower(e.Type)
+		switch {
+		case strings.Contains(errType, "rate_limit"), strings.Contains(errType, "quota"):
+			status = http.StatusTooManyRequests
+		case strings.Contains(errType, "invalid"), strings.Contains(errType, "validation"):
+			status = http.StatusBadRequest
+		default:
+			status = http.StatusBadGateway
+		}
+	}
+
+	switch status {
+	case http.StatusBadRequest:
+		return status, "invalid_request_error"
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return http.StatusBadGateway, "upstream_error"
+	case http.StatusNotFound:
+		return status, "not_found_error"
+	case http.StatusTooManyRequests:
+		return status, "rate_limit_error"
+	case http.StatusServiceUnavailable:
+		return status, "server_error"
+	default:
+		return status, "upstream_error"
+	}
+}
+
+// upstreamBodySnippet returns a short, readable excerpt of an upstream body for
+// error messages, with markup stripped and credential-like strings redacted
+func upstreamBodySnippet(body []byte) string {
+	text := redactSecrets(htmlTagPattern.ReplaceAllString(string(body), " "))
+	text = strings.TrimSpace(whitespacePattern.ReplaceAllString(text, " "))
+
+	if runes := []rune(text); len(runes) > maxUpstreamSnippet {
+		text = string(runes[:maxUpstreamSnippet]) + "…"
+	}
+	if text == "" {
+		return "(empty body)"
+	}
+	return text
+}
+
+// isEmptyCompletion reports whether an upstream response parsed successfully but
+// none of its choices carry text, reasoning or tool calls
+func isEmptyCompletion(body []byte) bool {
+	var atlassianResp AtlassianResponse
+	if err := json.Unmarshal(body, &atlassianResp); err != nil || atlassianResp.Error != nil {
+		return false
+	}
+	for _, choice := range atlassianResp.ResponsePayload.Choices {
+		if len(choice.Message.ToolCalls) > 0 {
+			return false
+		}
+		for _, element := range choice.Message.Content {
+			if strings.TrimSpace(element.Text) != "" || element.Thinking != "" || element.Type == "tool_use" {
+				return false
+			}
 		}
 	}
+	return true
 }
 
-// handleNonStreamingResponse processes non-streaming chat completion
-func handleNonStreamingResponse(c *gin.Context, resp *resty.Response, requestedModel string) {
+// redactSecrets replaces loaded credential tokens and other credential-like strings
+func redactSecrets(text string) string {
+	for _, cred := range loadedCredentials() {
+		if cred.Token != "" {
+			text = strings.ReplaceAll(text, cred.Token, "[REDACTED]")
+		}
+	}
+	return secretLikePattern.ReplaceAllString(text, "[REDACTED]")
+}
+
+// handleNonStreamingResponse processes non-streaming chat completion and returns
+// the response sent to the client, or nil if it failed. When structured is set,
+// message content is returned as typed content parts.
+func handleNonStreamingResponse(c *gin.Context, resp *resty.Response, requestedModel string, structured bool) *ChatCompletionResponse {
+	// Gateways and proxies in front of it sometimes answer with HTML error pages
+	contentType := resp.Header().Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "json") {
+		msg := fmt.Sprintf("Upstream returned a non-JSON response (status %d, content type %q): %s",
+			resp.StatusCode(), contentType, upstreamBodySnippet(resp.Body()))
+		log.Print(msg)
+		openAIError(c, http.StatusBadGateway, "upstream_error", msg)
+		return nil
+	}
+
 	var atlassianResp AtlassianResponse
 	if err := json.Unmarshal(resp.Body(), &atlassianResp); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to parse upstream response"})
-		return
+		msg := fmt.Sprintf("Failed to parse upstream response (status %d): %s",
+			resp.StatusCode(), upstreamBodySnippet(resp.Body()))
+		log.Print(msg)
+		openAIError(c, http.StatusBadGateway, "upstream_error", msg)
+		return nil
+	}
+
+	openaiResp := convertCompletion(c, atlassianResp, requestedModel, structured)
+	if openaiResp != nil {
+		c.JSON(http.StatusOK, openaiResp)
+	}
+	return openaiResp
+}
+
+// handleDecodedResponse is handleNonStreamingResponse for an unbuffered body:
+// the completion is decoded as it arrives and encoded straight to the client,
+// so the raw body is never held in memory alongside the parsed response.
+// The output is the same JSON.
+func handleDecodedResponse(c *gin.Context, resp *resty.Response, requestedModel string, structured bool) *ChatCompletionResponse {
+	body := resp.RawBody()
+	defer body.Close()
+
+	contentType := resp.Header().Get("Content-Type")
+	if contentType != "" && !strings.Contains(contentType, "json") {
+		head, _ := io.ReadAll(io.LimitReader(body, int64(4*maxUpstreamSnippet)))
+		msg := fmt.Sprintf("Upstream returned a non-JSON response (status %d, content type %q): %s",
+			resp.StatusCode(), contentType, upstreamBodySnippet(head))
+		log.Print(msg)
+		openAIError(c, http.StatusBadGateway, "upstream_error", msg)
+		return nil
+	}
+
+	var atlassianResp AtlassianResponse
+	if err := json.NewDecoder(body).Decode(&atlassianResp); err != nil {
+		msg := fmt.Sprintf("Failed to parse upstream response (status %d): %v", resp.StatusCode(), err)
+		log.Print(msg)
+		openAIError(c, http.StatusBadGateway, "upstream_error", msg)
+		return nil
+	}
+
+	openaiResp := convertCompletion(c, atlassianResp, requestedModel, structured)
+	if openaiResp != nil {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.Status(http.StatusOK)
+		if err := json.NewEncoder(c.Writer).Encode(openaiResp); err != nil {
+			log.Printf("Failed to write response: %v", err)
+		}
+	}
+	return openaiResp
+}
+
+// convertCompletion maps a parsed upstream response to the OpenAI format. An
+// error embedded in the response is written to the client instead, returning nil.
+func convertCompletion(c *gin.Context, atlassianResp AtlassianResponse, requestedModel string, structured bool) *ChatCompletionResponse {
+	// A 200 can still carry an error instead of a completion
+	if atlassianResp.Error != nil {
+		status, errType := upstreamErrorStatus(atlassianResp.Error)
+		msg := fmt.Sprintf("Upstream error: %s", atlassianResp.Error.Message)
+		log.Printf("%s (type %q, status %d)", msg, atlassianResp.Error.Type, atlassianResp.Error.Status)
+		openAIError(c, status, errType, msg)
+		return nil
 	}
 
 	// Convert to OpenAI format
 	openaiResp := ToOpenAI(atlassianResp, requestedModel)
-	c.JSON(http.StatusOK, openaiResp)
+	if structured {
+		withStructuredContent(&openaiResp, atlassianResp)
+	}
+	return &openaiResp
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// upstreamHealth caches the last gateway reachability check
+var upstreamHealth struct {
+	sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// checkUpstreamReachable sends a HEAD request to the gateway. Any response
+// below 500 means the gateway is reachable, even if it rejects the method.
+func checkUpstreamReachable(ctx context.Context) error {
+	req := SharedHTTPClient().client.R().SetContext(ctx)
+	if credentials := loadedCredentials(); len(credentials) > 0 {
+		req.SetHeaders(AuthHeaders(credentials[0].Email, credentials[0].Token))
+	}
+
+	resp, err := req.Head(AtlassianAPIEndpoint)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode() >= 500 {
+		return fmt.Errorf("gateway returned status %d", resp.StatusCode())
+	}
+	return nil
+}
+
+// UpstreamHealthCheck handles GET /health/upstream
+func UpstreamHealthCheck(c *gin.Context) {
+	upstreamHealth.Lock()
+	if time.Since(upstreamHealth.checkedAt) > UpstreamHealthCacheTTL {
+		// The result is shared by every caller, so the probe must not depend on
+		// this one staying connected; a cancelled probe says nothing and isn't cached
+		ctx, cancel := context.WithTimeout(context.Background(), UpstreamHealthTimeout)
+		if err := checkUpstreamReachable(ctx); !errors.Is(err, context.Canceled) {
+			upstreamHealth.err = err
+			upstreamHealth.checkedAt = time.Now()
+		}
+		cancel()
+	}
+	checkedAt, err := upstreamHealth.checkedAt, upstreamHealth.err
+	upstreamHealth.Unlock()
+
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":       "unreachable",
+			"error":        err.Error(),
+			"last_checked": checkedAt,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":       "ok",
+		"last_checked": checkedAt,
+	})
+}
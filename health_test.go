@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// resetUpstreamHealth forgets the cached probe result
+func resetUpstreamHealth(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		upstreamHealth.Lock()
+		upstreamHealth.checkedAt = time.Time{}
+		upstreamHealth.err = nil
+		upstreamHealth.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		upstream   roundTripFunc
+		wantCode   int
+		wantStatus string
+	}{
+		{"gateway healthy", func(*http.Request) (*http.Response, error) {
+			return jsonResponse(http.StatusOK, ""), nil
+		}, http.StatusOK, "ok"},
+		{"gateway rejects the method", func(*http.Request) (*http.Response, error) {
+			return jsonResponse(http.StatusMethodNotAllowed, ""), nil
+		}, http.StatusOK, "ok"},
+		{"gateway failing", func(*http.Request) (*http.Response, error) {
+			return jsonResponse(http.StatusBadGateway, ""), nil
+		}, http.StatusServiceUnavailable, "unreachable"},
+		{"gateway unreachable", func(*http.Request) (*http.Response, error) {
+			return nil, errors.New("connection refused")
+		}, http.StatusServiceUnavailable, "unreachable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUpstreamHealth(t)
+			useCredentials(t, testCredentials(1)...)
+			var method string
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				method = r.Method
+				return tt.upstream(r)
+			})
+
+			w := serve(http.MethodGet, "/health/upstream", "", nil)
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			var resp struct {
+				Status      string    `json:"status"`
+				LastChecked time.Time `json:"last_checked"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Status != tt.wantStatus {
+				t.Errorf("status field = %q, want %q", resp.Status, tt.wantStatus)
+			}
+			if resp.LastChecked.IsZero() {
+				t.Error("last_checked missing")
+			}
+			if method != http.MethodHead {
+				t.Errorf("probe method = %q, want HEAD", method)
+			}
+		})
+	}
+}
+
+func TestUpstreamHealthCheckCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        time.Duration
+		wantProbes int32
+	}{
+		{"cached within the TTL", time.Minute, 1},
+		{"probed again once expired", 0, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUpstreamHealth(t)
+			setValue(t, &UpstreamHealthCacheTTL, tt.ttl)
+			useCredentials(t, testCredentials(1)...)
+			var probes atomic.Int32
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				probes.Add(1)
+				return jsonResponse(http.StatusOK, ""), nil
+			})
+
+			for range 3 {
+				if w := serve(http.MethodGet, "/health/upstream", "", nil); w.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200", w.Code)
+				}
+			}
+
+			if got := probes.Load(); got != tt.wantProbes {
+				t.Errorf("probes = %d, want %d", got, tt.wantProbes)
+			}
+		})
+	}
+}
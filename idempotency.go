@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// idempotencyEntry is a cached response for an Idempotency-Key
+type idempotencyEntry struct {
+	response  ChatCompletionResponse
+	expiresAt time.Time
+}
+
+var (
+	idempotencyMu    sync.Mutex
+	idempotencyCache = make(map[string]idempotencyEntry)
+)
+
+// idempotencyCacheKey scopes a client-supplied key to the API token that sent it
+func idempotencyCacheKey(apiToken, key string) string {
+	return hashAPIToken(apiToken) + ":" + key
+}
+
+// getIdempotentResponse returns the cached response for a key if it hasn't expired
+func getIdempotentResponse(cacheKey string) (ChatCompletionResponse, bool) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+
+	entry, ok := idempotencyCache[cacheKey]
+	if !ok {
+		return ChatCompletionResponse{}, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(idempotencyCache, cacheKey)
+		return ChatCompletionResponse{}, false
+	}
+	return entry.response, true
+}
+
+// storeIdempotentResponse caches a response and evicts any expired entries
+func storeIdempotentResponse(cacheKey string, response ChatCompletionResponse) {
+	idempotencyMu.Lock()
+	defer idempotencyMu.Unlock()
+
+	now := time.Now()
+	for k, entry := range idempotencyCache {
+		if now.After(entry.expiresAt) {
+			delete(idempotencyCache, k)
+		}
+	}
+
+	idempotencyCache[cacheKey] = idempotencyEntry{
+		response:  response,
+		expiresAt: now.Add(IdempotencyTTL),
+	}
+}
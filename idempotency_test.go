@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		firstKey     string
+		secondKey    string
+		newToken     bool
+		stream       bool
+		ttl          time.Duration
+		wantCalls    int32
+		wantReplayed bool
+	}{
+		{"same key is replayed", "k1", "k1", false, false, time.Minute, 1, true},
+		{"different key", "k1", "k2", false, false, time.Minute, 2, false},
+		{"no key", "", "", false, false, time.Minute, 2, false},
+		{"keys are scoped to the API token", "k1", "k1", true, false, time.Minute, 2, false},
+		{"expired entry", "k1", "k1", false, false, time.Nanosecond, 2, false},
+		{"streams are never cached", "k1", "k1", false, true, time.Minute, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &IdempotencyTTL, tt.ttl)
+			useCredentials(t, testCredentials(1)...)
+			var calls atomic.Int32
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				if tt.stream {
+					return sseResponse(http.NoBody), nil
+				}
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("hi"))), nil
+			})
+			body := chatBody("")
+			if tt.stream {
+				body = chatBody(`"stream":true`)
+			}
+			send := func(token, key string) *http.Response {
+				header := http.Header{"Authorization": {"Bearer " + token}, "Content-Type": {"application/json"}}
+				if key != "" {
+					header.Set("Idempotency-Key", key)
+				}
+				w := serve(http.MethodPost, "/v1/chat/completions", body, header)
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+				}
+				return w.Result()
+			}
+
+			token := newAPIToken(t)
+			send(token, tt.firstKey)
+			if tt.newToken {
+				token = newAPIToken(t)
+			}
+			second := send(token, tt.secondKey)
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("upstream called %d times, want %d", got, tt.wantCalls)
+			}
+			if replayed := second.Header.Get("Idempotent-Replayed") == "true"; replayed != tt.wantReplayed {
+				t.Errorf("replayed = %v, want %v", replayed, tt.wantReplayed)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"atlassian/db"
+)
+
+// StartJanitor runs housekeeping every JanitorInterval until ctx is cancelled:
+// it deletes used or expired recovery tokens, request and audit logs older than
+// LogRetention, and the stats of credentials that are no longer loaded.
+// An interval of 0 disables it; a retention of 0 keeps logs forever.
+func StartJanitor(ctx context.Context) {
+	if JanitorInterval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(JanitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runJanitor()
+			}
+		}
+	}()
+}
+
+// runJanitor performs one housekeeping pass, logging failures and what was removed
+func runJanitor() {
+	if n, err := db.PurgeRecoveryTokens(); err != nil {
+		log.Printf("Janitor: failed to purge recovery tokens: %v", err)
+	} else if n > 0 {
+		log.Printf("Janitor: purged %d recovery tokens", n)
+	}
+
+	if LogRetention > 0 {
+		cutoff := time.Now().Add(-LogRetention)
+
+		if n, err := db.PurgeRequestLogs(cutoff); err != nil {
+			log.Printf("Janitor: failed to purge request logs: %v", err)
+		} else if n > 0 {
+			log.Printf("Janitor: purged %d request logs older than %s", n, LogRetention)
+		}
+
+		if n, err := db.PurgeAuditLogs(cutoff); err != nil {
+			log.Printf("Janitor: failed to purge audit logs: %v", err)
+		} else if n > 0 {
+			log.Printf("Janitor: purged %d audit logs older than %s", n, LogRetention)
+		}
+	}
+
+	if n := pruneCredentialStats(loadedCredentials()); n > 0 {
+		log.Printf("Janitor: dropped stats for %d removed credentials", n)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"atlassian/db"
+)
+
+func TestRunJanitor(t *testing.T) {
+	tests := []struct {
+		name         string
+		retention    time.Duration
+		wantRequests int64
+		wantAudits   int64
+	}{
+		{"logs kept forever by default", 0, 2, 2},
+		{"old logs purged", 24 * time.Hour, 1, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &LogRetention, tt.retention)
+			useCredentials(t, testCredentials(1)...)
+			now := time.Now()
+			old := now.Add(-48 * time.Hour)
+			requests := []db.RequestLog{
+				{CreatedAt: old, TokenHash: "janitor-test"},
+				{CreatedAt: now, TokenHash: "janitor-test"},
+			}
+			audits := []db.AuditLog{
+				{CreatedAt: old, Action: "janitor.test"},
+				{CreatedAt: now, Action: "janitor.test"},
+			}
+			used := now
+			tokens := []db.RecoveryToken{
+				{TokenHash: "janitor-valid", ExpiresAt: now.Add(time.Hour)},
+				{TokenHash: "janitor-used", ExpiresAt: now.Add(time.Hour), UsedAt: &used},
+				{TokenHash: "janitor-expired", ExpiresAt: now.Add(-time.Hour)},
+			}
+			for _, rows := range []interface{}{&requests, &audits, &tokens} {
+				if err := db.GetDB().Create(rows).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			t.Cleanup(func() {
+				db.GetDB().Where("token_hash = ?", "janitor-test").Delete(&db.RequestLog{})
+				db.GetDB().Where("action = ?", "janitor.test").Delete(&db.AuditLog{})
+				db.GetDB().Where("token_hash LIKE ?", "janitor-%").Delete(&db.RecoveryToken{})
+			})
+			recordCredentialResult("c0@example.com", 200, nil)
+			recordCredentialResult("removed@example.com", 200, nil)
+
+			runJanitor()
+
+			var gotRequests, gotAudits int64
+			db.GetDB().Model(&db.RequestLog{}).Where("token_hash = ?", "janitor-test").Count(&gotRequests)
+			db.GetDB().Model(&db.AuditLog{}).Where("action = ?", "janitor.test").Count(&gotAudits)
+			if gotRequests != tt.wantRequests || gotAudits != tt.wantAudits {
+				t.Errorf("kept %d request and %d audit logs, want %d and %d",
+					gotRequests, gotAudits, tt.wantRequests, tt.wantAudits)
+			}
+			var remaining []db.RecoveryToken
+			db.GetDB().Where("token_hash LIKE ?", "janitor-%").Find(&remaining)
+			if len(remaining) != 1 || remaining[0].TokenHash != "janitor-valid" {
+				t.Errorf("recovery tokens left = %+v, want only the valid one", remaining)
+			}
+			credStatsMu.Lock()
+			_, kept := credStats["c0@example.com"]
+			_, stale := credStats["removed@example.com"]
+			credStatsMu.Unlock()
+			if !kept || stale {
+				t.Errorf("stats kept for loaded = %v, removed = %v; want true, false", kept, stale)
+			}
+		})
+	}
+}
+
+func TestStartJanitor(t *testing.T) {
+	setValue(t, &JanitorInterval, 10*time.Millisecond)
+	used := time.Now()
+	token := db.RecoveryToken{TokenHash: "janitor-loop", ExpiresAt: used.Add(time.Hour), UsedAt: &used}
+	if err := db.GetDB().Create(&token).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Delete(&token) })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		cancel()
+		// Let a pass in progress finish before the settings are restored; each
+		// pass ends by taking credStatsMu, which orders it before this test's cleanup
+		time.Sleep(30 * time.Millisecond)
+		credStatsMu.Lock()
+		credStatsMu.Unlock()
+	})
+
+	StartJanitor(ctx)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for db.GetDB().First(&db.RecoveryToken{}, token.ID).Error == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("used recovery token never purged")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
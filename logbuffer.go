@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLine is one captured log line
+type logLine struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// logRing keeps the most recent log lines in a fixed-size circular buffer and
+// fans new lines out to live subscribers. It is an io.Writer for the log package.
+type logRing struct {
+	mu    sync.Mutex
+	lines []logLine
+	next  int  // Slot the next line is written to
+	full  bool // Whether the buffer has wrapped
+	seq   uint64
+	subs  map[chan logLine]struct{}
+}
+
+// newLogRing creates a buffer holding at most size lines
+func newLogRing(size int) *logRing {
+	return &logRing{
+		lines: make([]logLine, size),
+		subs:  make(map[chan logLine]struct{}),
+	}
+}
+
+// recentLogs holds the last LOG_BUFFER_LINES lines written through the log package
+var recentLogs = newLogRing(max(LogBufferLines, 1))
+
+// Write records each line of p, with secrets redacted
+func (r *logRing) Write(p []byte) (int, error) {
+	now := time.Now()
+	text := strings.TrimRight(string(p), "\n")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, line := range strings.Split(text, "\n") {
+		r.seq++
+		entry := logLine{Seq: r.seq, Time: now, Text: redactSecrets(line)}
+
+		r.lines[r.next] = entry
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+
+		// Slow subscribers miss lines rather than block logging
+		for ch := range r.subs {
+			select {
+			case ch <- entry:
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// Recent returns up to n of the most recent lines, oldest first; n <= 0 returns all
+func (r *logRing) Recent(n int) []logLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var ordered []logLine
+	if r.full {
+		ordered = append(ordered, r.lines[r.next:]...)
+	}
+	ordered = append(ordered, r.lines[:r.next]...)
+
+	if n > 0 && len(ordered) > n {
+		ordered = ordered[len(ordered)-n:]
+	}
+	return ordered
+}
+
+// Subscribe returns a channel receiving lines written from now on, and a
+// function that unsubscribes and closes it
+func (r *logRing) Subscribe() (<-chan logLine, func()) {
+	ch := make(chan logLine, 64)
+
+	r.mu.Lock()
+	r.subs[ch] = struct{}{}
+	r.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			r.mu.Lock()
+			delete(r.subs, ch)
+			r.mu.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogRingRecent(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		n      int
+		want   []string
+	}{
+		{"empty", nil, 0, nil},
+		{"partially filled", []string{"a", "b"}, 0, []string{"a", "b"}},
+		{"wrapped keeps newest", []string{"a", "b", "c", "d", "e"}, 0, []string{"c", "d", "e"}},
+		{"limited", []string{"a", "b", "c", "d"}, 2, []string{"c", "d"}},
+		{"multi-line write", []string{"a\nb\n", "c"}, 0, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ring := newLogRing(3)
+			for _, w := range tt.writes {
+				ring.Write([]byte(w))
+			}
+
+			var got []string
+			for _, line := range ring.Recent(tt.n) {
+				got = append(got, line.Text)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Recent(%d) = %v, want %v", tt.n, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogRingRedactsSecrets(t *testing.T) {
+	useCredentials(t, Credential{Email: "c0@example.com", Token: "short-token"})
+	ring := newLogRing(10)
+
+	ring.Write([]byte("using short-token and " + strings.Repeat("x", 40)))
+
+	if got := ring.Recent(0)[0].Text; got != "using [REDACTED] and [REDACTED]" {
+		t.Errorf("line = %q, want secrets redacted", got)
+	}
+}
+
+func TestLogsPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled int
+		query   string
+		want    []string
+	}{
+		{"all lines", 1000, "", []string{"first", "second", "third"}},
+		{"limited", 1000, "&lines=2", []string{"second", "third"}},
+		{"invalid limit", 1000, "&lines=-1", []string{"first", "second", "third"}},
+		{"disabled", 0, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &LogBufferLines, tt.enabled)
+			setValue(t, &recentLogs, newLogRing(10))
+			for _, text := range []string{"first", "second", "third"} {
+				recentLogs.Write([]byte(text + "\n"))
+			}
+
+			w := serve(http.MethodGet, "/admin/logs?format=json"+tt.query, "", adminHeader(t))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Lines []logLine `json:"lines"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, line := range resp.Lines {
+				got = append(got, line.Text)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("lines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamLogs(t *testing.T) {
+	tests := []struct {
+		name          string
+		keepalive     time.Duration
+		wantKeepalive bool
+	}{
+		{"keepalive disabled", 0, false},
+		{"keepalive enabled", 10 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &StreamKeepaliveInterval, tt.keepalive)
+			setValue(t, &recentLogs, newLogRing(10))
+			server := httptest.NewServer(testRouter())
+			t.Cleanup(server.Close)
+			req, err := http.NewRequest(http.MethodGet, server.URL+"/admin/logs/stream", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = adminHeader(t)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+				t.Fatalf("content type = %q, want text/event-stream", ct)
+			}
+
+			if tt.wantKeepalive {
+				time.Sleep(3 * tt.keepalive)
+			}
+			recentLogs.Write([]byte("streamed line\n"))
+
+			var gotKeepalive bool
+			reader := bufio.NewReader(resp.Body)
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					t.Fatalf("stream ended before the log line: %v", err)
+				}
+				if strings.HasPrefix(line, ": keepalive") {
+					gotKeepalive = true
+				}
+				if data, ok := strings.CutPrefix(line, "data: "); ok {
+					var entry logLine
+					if err := json.Unmarshal([]byte(data), &entry); err != nil {
+						t.Fatal(err)
+					}
+					if entry.Text != "streamed line" {
+						t.Errorf("streamed %q, want %q", entry.Text, "streamed line")
+					}
+					break
+				}
+			}
+			if gotKeepalive != tt.wantKeepalive {
+				t.Errorf("keepalive sent = %v, want %v", gotKeepalive, tt.wantKeepalive)
+			}
+		})
+	}
+}
+
+func TestStreamLogsDisabled(t *testing.T) {
+	setValue(t, &LogBufferLines, 0)
+
+	w := serve(http.MethodGet, "/admin/logs/stream", "", adminHeader(t))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -1,51 +1,144 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"atlassian/auth"
 	"atlassian/db"
 )
 
 func main() {
+	recoveryToken := flag.Bool("recovery-token", false, "生成一次性的管理员密码恢复令牌并退出")
+	flag.Parse()
+
+	// 同时保留最近的日志，供管理后台查看
+	if LogBufferLines > 0 {
+		log.SetOutput(io.MultiWriter(os.Stderr, recentLogs))
+	}
+
 	_, err := db.InitDB()
 	if err != nil {
 		log.Fatalf("初始化数据库失败: %v", err)
 	}
-	var adminPasswordErr error
-	_, _, adminPasswordErr = db.GetAdminPassword()
-	if adminPasswordErr != nil {
-		initialPassword := db.GenerateRandomPassword(12)
-		hashedPassword := auth.HashPassword(initialPassword)
-		err = db.SetAdminPassword(hashedPassword, true)
+	if err := auth.Init(); err != nil {
+		log.Fatalf("配置错误: %v", err)
+	}
+	// JWT 密钥来源：显式设置的 JWT_SECRET 优先，其次是运行时轮换后持久化的密钥，最后是内置默认值
+	if auth.Algorithm() == "HS256" {
+		persisted, err := db.GetJWTSecret()
+		if err != nil {
+			log.Fatalf("读取 JWT 密钥失败: %v", err)
+		}
+		switch {
+		case os.Getenv("JWT_SECRET") != "":
+			jwtSecretSource = "JWT_SECRET"
+			if persisted != "" {
+				log.Printf("JWT 密钥来自 JWT_SECRET，忽略数据库中运行时轮换的密钥")
+			} else {
+				log.Printf("JWT 密钥来自 JWT_SECRET")
+			}
+		case persisted != "":
+			if err := auth.SetSecret(persisted, 0); err != nil {
+				log.Fatalf("加载已持久化的 JWT 密钥失败: %v", err)
+			}
+			jwtSecretSource = "database"
+			log.Printf("JWT 密钥来自数据库（运行时轮换）")
+		default:
+			jwtSecretSource = "default"
+			log.Printf("警告: 未设置 JWT_SECRET，使用内置默认 JWT 密钥")
+		}
+	}
+
+	// 为忘记密码的管理员生成恢复令牌，在 /admin/recover 使用
+	if *recoveryToken {
+		token, err := issueRecoveryToken()
 		if err != nil {
-			log.Fatalf("设置初始密码失败: %v", err)
+			log.Fatalf("生成恢复令牌失败: %v", err)
 		}
+		fmt.Printf("\n🔑 密码恢复令牌（%s 内有效，仅可使用一次）:\n%s\n", RecoveryTokenTTL, token)
+		fmt.Printf("请访问 /admin/recover 使用此令牌重置管理员密码\n\n")
+		return
+	}
+
+	initialPassword, seeded, err := ensureAdminPassword()
+	if err != nil {
+		log.Fatalf("设置初始密码失败: %v", err)
+	}
+	if initialPassword != "" {
 		IsFirstRun = true
-		fmt.Printf("\n🔐 初始管理员密码: %s\n", initialPassword)
+		if seeded {
+			fmt.Printf("\n🔐 已使用 ADMIN_INITIAL_PASSWORD 设置初始管理员密码\n")
+		} else {
+			fmt.Printf("\n🔐 初始管理员密码: %s\n", initialPassword)
+		}
 		fmt.Printf("请在首次登录后立即修改此密码\n\n")
 	}
 
-	// 从数据库加载凭据
+	// 校验默认模型和凭据选择策略配置
+	if err := ValidateDefaultModel(); err != nil {
+		log.Fatalf("配置错误: %v", err)
+	}
+	if err := ValidateCredentialStrategy(); err != nil {
+		log.Fatalf("配置错误: %v", err)
+	}
+
+	// 从数据库加载凭据和停用的模型
 	LoadCredentials()
+	LoadDisabledModels()
+
+	// 启动请求日志后台写入
+	StartRequestLogWriter()
+
+	// 进程退出时取消后台任务
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// 后台凭据健康检查
+	StartCredentialHealthChecks(ctx)
+
+	// 定期清理过期令牌与旧日志
+	StartJanitor(ctx)
+
+	// 可选的启动自检
+	if envBool("STARTUP_SELF_CHECK", false) {
+		if !RunStartupSelfCheck() && envBool("STRICT_STARTUP", false) {
+			log.Fatalf("启动自检失败，STRICT_STARTUP 已启用，退出")
+		}
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8000"
 	}
 
+	host := os.Getenv("BIND_ADDRESS")
+	if host == "" {
+		host = os.Getenv("HOST")
+	}
+
 	router := SetupRoutes()
 
 	fmt.Printf("🚀 OpenAI‑Compatible Proxy via Atlassian AI Gateway\n")
 	fmt.Printf("📡 Server starting on port %s\n", port)
-	fmt.Printf("🔗 Base URL: http://localhost:%s/v1\n", port)
+	fmt.Printf("🔗 Base URL: http://%s/v1\n", net.JoinHostPort(displayHost(host), port))
 	fmt.Printf("📋 Endpoints:\n")
 	fmt.Printf("   • GET  /v1/models\n")
+	fmt.Printf("   • GET  /v1/models/:model\n")
 	fmt.Printf("   • POST /v1/chat/completions\n")
 	fmt.Printf("   • GET  /health\n")
-	fmt.Printf("🔐 Configured with %d credential(s)\n", len(Credentials))
+	fmt.Printf("   • GET  /health/upstream\n")
+	fmt.Printf("   • GET  /metrics\n")
+	fmt.Printf("🔐 Configured with %d credential(s)\n", len(loadedCredentials()))
 
 	if DebugMode {
 		fmt.Printf("🐛 Debug mode: ENABLED\n")
@@ -53,10 +146,57 @@ func main() {
 
 	fmt.Printf("\n")
 
-	address := fmt.Sprintf(":%s", port)
+	address := listenAddress(host, port)
 	log.Printf("Server listening on %s", address)
 
-	if err := router.Run(address); err != nil {
+	server := &http.Server{Addr: address, Handler: router}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Printf("Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		log.Fatalf("Failed to start server: %v", err)
 	}
+
+	// ListenAndServe returns as soon as shutdown begins; wait for in-flight
+	// requests, then persist the request logs they queued
+	<-shutdownDone
+	StopRequestLogWriter()
+}
+
+// ensureAdminPassword 在尚无管理员密码时设置初始密码，优先使用环境变量
+// ADMIN_INITIAL_PASSWORD，否则随机生成。返回所设置的密码，已有密码时为空
+func ensureAdminPassword() (password string, seeded bool, err error) {
+	if _, _, err := db.GetAdminPassword(); err == nil {
+		return "", false, nil
+	}
+
+	password = os.Getenv("ADMIN_INITIAL_PASSWORD")
+	seeded = password != ""
+	if !seeded {
+		password = db.GenerateRandomPassword(12)
+	}
+	if err := db.SetAdminPassword(auth.HashPassword(password), true); err != nil {
+		return "", false, err
+	}
+	return password, seeded, nil
+}
+
+// listenAddress builds the listen address; an empty host binds all interfaces
+func listenAddress(host, port string) string {
+	return net.JoinHostPort(host, port)
+}
+
+// displayHost returns a host suitable for printing a reachable URL
+func displayHost(host string) string {
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		return "localhost"
+	}
+	return host
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"atlassian/auth"
+	"atlassian/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// testModel is a supported model used by handler tests
+const testModel = "anthropic:claude-sonnet-4@20250514"
+
+// TestMain runs the tests against a throwaway SQLite database with logging silenced
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "proxy-test")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	log.SetOutput(io.Discard)
+	gin.DefaultWriter = io.Discard
+	gin.SetMode(gin.TestMode)
+	if _, err := db.InitDB(); err != nil {
+		log.Fatal(err)
+	}
+	if err := auth.Init(); err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// setValue overrides a package variable for the duration of a test
+func setValue[T any](t *testing.T, p *T, v T) {
+	t.Helper()
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// roundTripFunc fakes the upstream gateway at the transport level
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// useUpstream routes every upstream call through fn for the duration of a test
+func useUpstream(t *testing.T, fn roundTripFunc) *HTTPClient {
+	t.Helper()
+	client := NewHTTPClient()
+	client.client.SetTransport(fn)
+	setValue(t, &SharedHTTPClient, func() *HTTPClient { return client })
+	return client
+}
+
+// useCredentials replaces the loaded credentials and clears per-credential state
+func useCredentials(t *testing.T, creds ...Credential) {
+	t.Helper()
+	setValue(t, &Credentials, creds)
+	resetCredentialState()
+	t.Cleanup(resetCredentialState)
+}
+
+// resetCredentialState forgets stats, slots and rotation cursors left by earlier tests
+func resetCredentialState() {
+	credStatsMu.Lock()
+	credStats = make(map[string]*credentialStats)
+	credStatsMu.Unlock()
+
+	credentialInFlightMu.Lock()
+	credentialInFlight = make(map[string]int)
+	credentialQueue.Init()
+	credentialInFlightMu.Unlock()
+
+	rotationCursor.Store(0)
+}
+
+// testCredentials returns n credentials named c0@example.com, c1@example.com, ...
+func testCredentials(n int) []Credential {
+	creds := make([]Credential, n)
+	for i := range creds {
+		creds[i] = Credential{Email: "c" + string(rune('0'+i)) + "@example.com", Token: "token-" + string(rune('0'+i)), Weight: 1}
+	}
+	return creds
+}
+
+// jsonResponse builds an upstream response with a JSON body
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// sseResponse builds an upstream event stream from the given body
+func sseResponse(body io.ReadCloser) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/event-stream"}},
+		Body:       body,
+	}
+}
+
+// upstreamCompletion is a non-streaming gateway response carrying the given content
+func upstreamCompletion(content ...AtlassianContentElement) string {
+	stop := "stop"
+	data, _ := json.Marshal(AtlassianResponse{
+		ResponsePayload: AtlassianResponsePayload{
+			ID:      "msg_1",
+			Created: 1700000000,
+			Choices: []AtlassianResponseChoice{{
+				Message:      AtlassianResponseMessage{Role: "assistant", Content: content},
+				FinishReason: &stop,
+			}},
+		},
+		PlatformAttributes: AtlassianPlatformAttrs{Model: "claude-sonnet-4@20250514"},
+	})
+	return string(data)
+}
+
+// upstreamCompletionWithUsage is upstreamCompletion with the gateway's token metrics
+func upstreamCompletionWithUsage(prompt, completion int, content ...AtlassianContentElement) string {
+	var resp AtlassianResponse
+	json.Unmarshal([]byte(upstreamCompletion(content...)), &resp)
+	total := prompt + completion
+	resp.Metrics = &AtlassianMetrics{Usage: ChatCompletionUsage{PromptTokens: &prompt, CompletionTokens: &completion, TotalTokens: &total}}
+	data, _ := json.Marshal(resp)
+	return string(data)
+}
+
+// textElement is a plain text content element
+func textElement(text string) AtlassianContentElement {
+	return AtlassianContentElement{Type: "text", Text: text}
+}
+
+// sseFrame formats a gateway stream chunk carrying the given content as one SSE frame
+func sseFrame(finishReason string, content ...AtlassianContentElement) string {
+	choice := AtlassianResponseChoice{Message: AtlassianResponseMessage{Role: "assistant", Content: content}}
+	if finishReason != "" {
+		choice.FinishReason = &finishReason
+	}
+	data, _ := json.Marshal(AtlassianStreamChunk{
+		ResponsePayload: AtlassianResponsePayload{ID: "msg_1", Created: 1700000000, Choices: []AtlassianResponseChoice{choice}},
+	})
+	return "data: " + string(data) + "\n\n"
+}
+
+// testRouter is the full router, built once since templates are parsed on setup
+var testRouter = sync.OnceValue(SetupRoutes)
+
+// serve sends a request through the router
+func serve(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	w := httptest.NewRecorder()
+	testRouter().ServeHTTP(w, req)
+	return w
+}
+
+// newAPIToken issues a fresh API token, replacing any earlier one
+func newAPIToken(t *testing.T) string {
+	t.Helper()
+	token, err := db.GenerateAPIToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetAPITokenModels(""); err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// postChat sends a chat completion request with a fresh API token
+func postChat(t *testing.T, body string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	h := http.Header{"Authorization": {"Bearer " + newAPIToken(t)}, "Content-Type": {"application/json"}}
+	for key, values := range header {
+		h[key] = values
+	}
+	return serve(http.MethodPost, "/v1/chat/completions", body, h)
+}
+
+// chatBody builds a minimal chat completion request body with extra top-level fields
+func chatBody(extra string) string {
+	body := `{"model":"` + testModel + `","messages":[{"role":"user","content":"hi"}]`
+	if extra != "" {
+		body += "," + extra
+	}
+	return body + "}"
+}
+
+// decodeError extracts the OpenAI-style error object from a response
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) (message, errType, param string) {
+	t.Helper()
+	var resp struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Param   string `json:"param"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode error body %q: %v", w.Body.String(), err)
+	}
+	return resp.Error.Message, resp.Error.Type, resp.Error.Param
+}
+
+// adminHeader returns a session cookie for an admin who has changed the initial password
+func adminHeader(t *testing.T) http.Header {
+	t.Helper()
+	if err := db.SetAdminPassword(auth.HashPassword("admin-password"), false); err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.GenerateToken(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{"Cookie": {CookieName + "=" + token}}
+}
+
+// postForm sends a form as an authenticated admin
+func postForm(t *testing.T, path string, form url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	h := adminHeader(t)
+	h.Set("Content-Type", "application/x-www-form-urlencoded")
+	return serve(http.MethodPost, path, form.Encode(), h)
+}
+
+// clearCredentials deletes every stored credential
+func clearCredentials(t *testing.T) {
+	t.Helper()
+	if err := db.GetDB().Where("1 = 1").Delete(&db.Credential{}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// upstreamRequest is a minimal gateway request for testModel
+func upstreamRequest() AtlassianRequest {
+	return AtlassianRequest{
+		RequestPayload:     AtlassianRequestPayload{Messages: []ChatMessage{{Role: "user", Content: "hi"}}},
+		PlatformAttributes: AtlassianPlatformAttrs{Model: TransformModelID(testModel)},
+	}
+}
+
+// openStream fetches a streamed response from the fake upstream
+func openStream(t *testing.T, fn roundTripFunc) *StreamResponse {
+	t.Helper()
+	client := useUpstream(t, fn)
+	resp, err := client.FetchWithRetry(context.Background(), upstreamRequest(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &StreamResponse{Response: resp, Model: testModel}
+}
+
+// drainStream collects every line of a stream and its final error
+func drainStream(lines <-chan []byte, errs <-chan error) ([]string, error) {
+	var got []string
+	for line := range lines {
+		got = append(got, string(line))
+	}
+	return got, <-errs
+}
+
+// disableModels marks the models disabled for the duration of a test
+func disableModels(t *testing.T, ids ...string) {
+	t.Helper()
+	disabled := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		disabled[TransformModelID(id)] = true
+	}
+	disabledModelsMu.Lock()
+	old := disabledModels
+	disabledModels = disabled
+	disabledModelsMu.Unlock()
+	t.Cleanup(func() {
+		disabledModelsMu.Lock()
+		disabledModels = old
+		disabledModelsMu.Unlock()
+	})
+}
+
+// clearModelsCache drops the cached /v1/models response
+func clearModelsCache() {
+	modelsCache.Lock()
+	modelsCache.response = nil
+	modelsCache.Unlock()
+}
+
+// waitForAudit waits for an audit entry recording action at or after since,
+// as entries are written in the background and may land out of order
+func waitForAudit(t *testing.T, action string, since time.Time) db.AuditLog {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries, _, err := db.GetAuditLogs(1, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if entry.Action == action && !entry.CreatedAt.Before(since) {
+				return entry
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no %s audit entry since %v; newest are %+v", action, since, entries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// requestEmail returns the credential email an upstream request authenticated with
+func requestEmail(r *http.Request) string {
+	decoded, _ := base64.StdEncoding.DecodeString(r.Header.Get("X-Atlassian-EncodedToken"))
+	email, _, _ := strings.Cut(string(decoded), ":")
+	return email
+}
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		host, port  string
+		wantListen  string
+		wantDisplay string
+	}{
+		{"", "8000", ":8000", "localhost"},
+		{"0.0.0.0", "8000", "0.0.0.0:8000", "localhost"},
+		{"127.0.0.1", "9000", "127.0.0.1:9000", "127.0.0.1"},
+		{"::", "8000", "[::]:8000", "localhost"},
+		{"::1", "8000", "[::1]:8000", "::1"},
+	}
+	for _, tt := range tests {
+		if got := listenAddress(tt.host, tt.port); got != tt.wantListen {
+			t.Errorf("listenAddress(%q, %q) = %q, want %q", tt.host, tt.port, got, tt.wantListen)
+		}
+		if got := displayHost(tt.host); got != tt.wantDisplay {
+			t.Errorf("displayHost(%q) = %q, want %q", tt.host, got, tt.wantDisplay)
+		}
+	}
+}
+
+func TestEnsureAdminPassword(t *testing.T) {
+	tests := []struct {
+		name       string
+		existing   bool
+		env        string
+		wantSet    bool
+		wantSeeded bool
+	}{
+		{"keeps an existing password", true, "from-env", false, false},
+		{"seeds from the environment", false, "from-env", true, true},
+		{"generates a random password", false, "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_INITIAL_PASSWORD", tt.env)
+			db.GetDB().Where("1 = 1").Delete(&db.AdminPassword{})
+			if tt.existing {
+				if err := db.SetAdminPassword(auth.HashPassword("existing"), false); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			password, seeded, err := ensureAdminPassword()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if (password != "") != tt.wantSet || seeded != tt.wantSeeded {
+				t.Fatalf("ensureAdminPassword() = %q, %v; want set %v, seeded %v", password, seeded, tt.wantSet, tt.wantSeeded)
+			}
+			if tt.wantSeeded && password != tt.env {
+				t.Errorf("password = %q, want %q", password, tt.env)
+			}
+			hash, isInitial, err := db.GetAdminPassword()
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantPassword := "existing"
+			if tt.wantSet {
+				wantPassword = password
+			}
+			if !auth.VerifyPassword(hash, wantPassword) || isInitial != tt.wantSet {
+				t.Errorf("stored password matches %q: %v, initial %v; want true, %v",
+					wantPassword, auth.VerifyPassword(hash, wantPassword), isInitial, tt.wantSet)
+			}
+		})
+	}
+}
+
+// decodeUpstream decodes the gateway request body sent to the fake upstream
+func decodeUpstream(t *testing.T, r *http.Request) AtlassianRequest {
+	t.Helper()
+	var req AtlassianRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		t.Errorf("decode upstream request: %v", err)
+	}
+	return req
+}
+
+// ptr returns a pointer to v
+func ptr[T any](v T) *T {
+	return &v
+}
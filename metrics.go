@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metric is anything that can write itself in the Prometheus text format
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+// registerMetric adds a metric to the /metrics output
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// Default latency buckets in seconds
+var latencyBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	// Time from receiving a streaming request to forwarding its first chunk
+	streamTimeToFirstToken = newHistogram("proxy_stream_time_to_first_token_seconds",
+		"Time from request start to the first chunk forwarded to the client.", latencyBuckets)
+
+	// Time from receiving a streaming request to the end of its stream
+	streamDuration = newHistogram("proxy_stream_duration_seconds",
+		"Total duration of streamed responses.", latencyBuckets)
+
+	// Upstream calls that failed with every attempt used up
+	credentialExhaustions = newCounter("proxy_credentials_exhausted_total",
+		"Upstream requests that failed after exhausting all credential attempts.")
+
+	// Upstream attempts per credential, labeled by masked email so the label set
+	// is bounded by the configured credentials and never carries a token
+	credentialSelections = newCounterVec("proxy_credential_selections_total",
+		"Upstream attempts made with each credential.", "credential")
+	credentialSuccesses = newCounterVec("proxy_credential_successes_total",
+		"Upstream attempts with each credential that returned a successful status.", "credential")
+	credentialFailures = newCounterVec("proxy_credential_failures_total",
+		"Upstream attempts with each credential that failed or returned an error status.", "credential")
+)
+
+// counter is a monotonically increasing count
+type counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// newCounter creates and registers a counter
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	registerMetric(c)
+	return c
+}
+
+// Inc adds one to the counter
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	fmt.Fprintf(w, "%s %d\n", c.name, c.value.Load())
+}
+
+// counterVec is a set of counters distinguished by the value of one label
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+// newCounterVec creates and registers a counter with one label
+func newCounterVec(name, help, label string) *counterVec {
+	v := &counterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+	registerMetric(v)
+	return v
+}
+
+// Inc adds one to the counter for the given label value
+func (v *counterVec) Inc(labelValue string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values[labelValue]++
+}
+
+func (v *counterVec) writeTo(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+	labelValues := make([]string, 0, len(v.values))
+	for lv := range v.values {
+		labelValues = append(labelValues, lv)
+	}
+	sort.Strings(labelValues)
+	for _, lv := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", v.name, v.label, labelValueEscaper.Replace(lv), v.values[lv])
+	}
+}
+
+// labelValueEscaper escapes a label value for the Prometheus text format
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// histogram is a fixed-bucket cumulative histogram
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// newHistogram creates and registers a histogram with the given upper bounds
+func newHistogram(name, help string, buckets []float64) *histogram {
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &histogram{
+		name:    name,
+		help:    help,
+		buckets: sorted,
+		counts:  make([]uint64, len(sorted)),
+	}
+	registerMetric(h)
+	return h
+}
+
+// Observe records one value
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, strconv.FormatFloat(upper, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// MetricsHandler serves all registered metrics in the Prometheus text format
+func MetricsHandler(c *gin.Context) {
+	metricsMu.Lock()
+	registered := append([]metric(nil), metrics...)
+	metricsMu.Unlock()
+
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	for _, m := range registered {
+		m.writeTo(c.Writer)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// histogramCount returns how many values h has recorded
+func histogramCount(h *histogram) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+func TestHistogramWriteTo(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+		want   []string
+	}{
+		{"empty", nil, []string{`h_bucket{le="1"} 0`, `h_bucket{le="+Inf"} 0`, "h_sum 0", "h_count 0"}},
+		{"cumulative buckets", []float64{0.5, 1, 3, 20}, []string{
+			`h_bucket{le="1"} 2`, `h_bucket{le="5"} 3`, `h_bucket{le="+Inf"} 4`, "h_sum 24.5", "h_count 4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &histogram{name: "h", help: "test", buckets: []float64{1, 5}, counts: make([]uint64, 2)}
+			for _, v := range tt.values {
+				h.Observe(v)
+			}
+
+			var out strings.Builder
+			h.writeTo(&out)
+
+			for _, line := range tt.want {
+				if !strings.Contains(out.String(), line+"\n") {
+					t.Errorf("output lacks %q:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestStreamTimeToFirstToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		upstream     roundTripFunc
+		wantTTFT     uint64
+		wantDuration uint64
+	}{
+		{"recorded on the first chunk", func(*http.Request) (*http.Response, error) {
+			body := sseFrame("", textElement("Hello")) + sseFrame("", textElement(" world")) + sseFrame("end_turn")
+			return sseResponse(io.NopCloser(strings.NewReader(body))), nil
+		}, 1, 1},
+		{"not recorded when nothing is forwarded", func(*http.Request) (*http.Response, error) {
+			pr, pw := io.Pipe()
+			pw.CloseWithError(errors.New("connection reset"))
+			return sseResponse(pr), nil
+		}, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, tt.upstream)
+			ttft, duration := histogramCount(streamTimeToFirstToken), histogramCount(streamDuration)
+
+			postChat(t, chatBody(`"stream":true`), nil)
+
+			if got := histogramCount(streamTimeToFirstToken) - ttft; got != tt.wantTTFT {
+				t.Errorf("time to first token observations = %d, want %d", got, tt.wantTTFT)
+			}
+			if got := histogramCount(streamDuration) - duration; got != tt.wantDuration {
+				t.Errorf("stream duration observations = %d, want %d", got, tt.wantDuration)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	w := serve(http.MethodGet, "/metrics", "", nil)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	for _, name := range []string{"proxy_stream_time_to_first_token_seconds", "proxy_stream_duration_seconds"} {
+		if !strings.Contains(w.Body.String(), "# TYPE "+name+" histogram\n") {
+			t.Errorf("metrics lack histogram %s", name)
+		}
+	}
+}
+
+func TestCredentialExhaustionCounter(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantCount  uint64
+		wantLogged []string
+	}{
+		{"all credentials fail", http.StatusBadGateway, 1, []string{
+			"WARN all credentials exhausted", "attempts=3", "c0@example.com: status 502", "c1@example.com: status 502",
+		}},
+		{"success", http.StatusOK, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &MaxRetries, 3)
+			useCredentials(t, testCredentials(2)...)
+			client := useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return jsonResponse(tt.status, upstreamCompletion(textElement("ok"))), nil
+			})
+			var logged strings.Builder
+			log.SetOutput(&logged)
+			t.Cleanup(func() { log.SetOutput(io.Discard) })
+			before := credentialExhaustions.value.Load()
+
+			client.FetchWithRetry(context.Background(), upstreamRequest(), false)
+
+			if got := credentialExhaustions.value.Load() - before; got != tt.wantCount {
+				t.Errorf("exhaustions counted = %d, want %d", got, tt.wantCount)
+			}
+			w := serve(http.MethodGet, "/metrics", "", nil)
+			if want := fmt.Sprintf("proxy_credentials_exhausted_total %d\n", credentialExhaustions.value.Load()); !strings.Contains(w.Body.String(), want) {
+				t.Errorf("metrics lack %q", want)
+			}
+			for _, want := range tt.wantLogged {
+				if !strings.Contains(logged.String(), want) {
+					t.Errorf("log lacks %q:\n%s", want, logged.String())
+				}
+			}
+		})
+	}
+}
+
+func TestCounterVecWriteTo(t *testing.T) {
+	v := &counterVec{name: "c", help: "test", label: "credential", values: make(map[string]uint64)}
+	v.Inc("b")
+	v.Inc("a")
+	v.Inc("b")
+	v.Inc(`q"\`)
+
+	var out strings.Builder
+	v.writeTo(&out)
+
+	want := "# HELP c test\n# TYPE c counter\n" +
+		`c{credential="a"} 1` + "\n" + `c{credential="b"} 2` + "\n" + `c{credential="q\"\\"} 1` + "\n"
+	if out.String() != want {
+		t.Errorf("writeTo() =\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestCredentialCounters(t *testing.T) {
+	setValue(t, &CredentialStrategy, "priority")
+	useCredentials(t, Credential{Email: "failing@example.com", Token: "t0"}, Credential{Email: "working@example.com", Token: "t1"})
+	count := func(v *counterVec, email string) uint64 {
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		return v.values[maskEmail(email)]
+	}
+	before := map[*counterVec][2]uint64{}
+	for _, v := range []*counterVec{credentialSelections, credentialSuccesses, credentialFailures} {
+		before[v] = [2]uint64{count(v, "failing@example.com"), count(v, "working@example.com")}
+	}
+	client := useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		if requestEmail(r) == "failing@example.com" {
+			return jsonResponse(http.StatusUnauthorized, `{}`), nil
+		}
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	if _, err := client.FetchWithRetry(context.Background(), upstreamRequest(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		counter *counterVec
+		want    [2]uint64
+	}{
+		{"selections", credentialSelections, [2]uint64{1, 1}},
+		{"successes", credentialSuccesses, [2]uint64{0, 1}},
+		{"failures", credentialFailures, [2]uint64{1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := [2]uint64{
+				count(tt.counter, "failing@example.com") - before[tt.counter][0],
+				count(tt.counter, "working@example.com") - before[tt.counter][1],
+			}
+			if got != tt.want {
+				t.Errorf("failing, working = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	w := serve(http.MethodGet, "/metrics", "", nil)
+	if body := w.Body.String(); !strings.Contains(body, `proxy_credential_selections_total{credential="wo***@example.com"}`) ||
+		strings.Contains(body, "working@example.com") {
+		t.Errorf("/metrics does not list the masked credential:\n%s", body)
+	}
+}
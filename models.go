@@ -1,24 +1,85 @@
 package main
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 // OpenAI API request/response structures
 
 // ChatCompletionRequest represents the OpenAI chat completion request
 type ChatCompletionRequest struct {
-	Model       string                 `json:"model"`
-	Messages    []ChatMessage          `json:"messages"`
-	Temperature *float64               `json:"temperature,omitempty"`
-	Stream      bool                   `json:"stream,omitempty"`
-	MaxTokens   *int                   `json:"max_tokens,omitempty"`
-	TopP        *float64               `json:"top_p,omitempty"`
-	Stop        interface{}            `json:"stop,omitempty"`
-	User        string                 `json:"user,omitempty"`
-	Extra       map[string]interface{} `json:"-"`
+	Model          string                 `json:"model"`
+	Messages       []ChatMessage          `json:"messages"`
+	Temperature    *float64               `json:"temperature,omitempty"`
+	Stream         bool                   `json:"stream,omitempty"`
+	MaxTokens      *int                   `json:"max_tokens,omitempty"`
+	TopP           *float64               `json:"top_p,omitempty"`
+	Stop           interface{}            `json:"stop,omitempty"`
+	User           string                 `json:"user,omitempty"`
+	ResponseFormat *ResponseFormat        `json:"response_format,omitempty"`
+	DryRun         bool                   `json:"dry_run,omitempty"`
+	StreamOptions  *StreamOptions         `json:"stream_options,omitempty"`
+	LogitBias      map[string]float64     `json:"logit_bias,omitempty"`
+	Extra          map[string]interface{} `json:"-"`
+
+	// Return message content as an array of typed parts instead of a string
+	StructuredContent bool `json:"structured_content,omitempty"`
+
+	// Tool definitions forwarded to the gateway
+	Tools []Tool `json:"tools,omitempty"`
+
+	// Client tags stored with the request log. The gateway keeps no completions,
+	// so store is accepted for compatibility and otherwise ignored.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Store    *bool             `json:"store,omitempty"`
+}
+
+// Tool represents an OpenAI tool definition
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+// ToolFunction describes a callable function and its JSON-schema parameters
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// StreamOptions represents the OpenAI stream_options field
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+// ResponseFormat represents the OpenAI response_format option
+type ResponseFormat struct {
+	Type string `json:"type"`
 }
 
 // ChatMessage represents a single message in the conversation
 type ChatMessage struct {
-	Role    string      `json:"role"`
-	Content interface{} `json:"content"`
+	Role             string      `json:"role"`
+	Content          interface{} `json:"content"`
+	ReasoningContent string      `json:"reasoning_content,omitempty"`
+	ToolCalls        []ToolCall  `json:"tool_calls,omitempty"`
+	ToolCallID       string      `json:"tool_call_id,omitempty"` // On "tool" messages, the call being answered
+	Name             string      `json:"name,omitempty"`
+}
+
+// ToolCall represents an OpenAI tool call, or a fragment of one in a stream delta
+type ToolCall struct {
+	Index    *int             `json:"index,omitempty"`
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+// ToolCallFunction holds the function name and (possibly partial) JSON arguments
+type ToolCallFunction struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
 }
 
 type Content struct {
@@ -27,7 +88,8 @@ type Content struct {
 }
 
 // ToOpenAIRequest 将自定义请求转换为标准OpenAI格式
-func (r *ChatCompletionRequest) ToOpenAIRequest() ChatCompletionRequest {
+// 遇到无法识别的 content 类型时返回错误，并指明消息下标
+func (r *ChatCompletionRequest) ToOpenAIRequest() (ChatCompletionRequest, error) {
 	// 转换消息格式
 	messages := make([]ChatMessage, len(r.Messages))
 	for i, msg := range r.Messages {
@@ -47,20 +109,36 @@ func (r *ChatCompletionRequest) ToOpenAIRequest() ChatCompletionRequest {
 					}
 				}
 			}
+		case nil:
+			// e.g. assistant messages that only carry tool calls
+		case float64, bool:
+			content = fmt.Sprint(v)
+		default:
+			return ChatCompletionRequest{}, fmt.Errorf("messages[%d].content has unsupported type %T", i, v)
 		}
+		// Tool calls and the IDs answering them carry multi-turn tool use through
 		messages[i] = ChatMessage{
-			Role:    msg.Role,
-			Content: content,
+			Role:       msg.Role,
+			Content:    content,
+			ToolCalls:  msg.ToolCalls,
+			ToolCallID: msg.ToolCallID,
+			Name:       msg.Name,
 		}
 	}
 
-	// 构建标准OpenAI请求格式
-	return ChatCompletionRequest{
-		Model:       r.Model,
-		Temperature: r.Temperature,
-		Messages:    messages,
-		Stream:      r.Stream,
+	// JSON 模式：网关不保证遵循 response_format，额外注入系统指令
+	if r.ResponseFormat != nil && r.ResponseFormat.Type == "json_object" {
+		messages = append([]ChatMessage{{
+			Role:    "system",
+			Content: JSONModeInstruction,
+		}}, messages...)
 	}
+
+	// 构建标准OpenAI请求格式：复制原请求，仅替换消息，
+	// 以保留 temperature: 0、top_p: 0 等“显式为零”与“未设置”的区别
+	out := *r
+	out.Messages = messages
+	return out, nil
 }
 
 // ChatCompletionResponse represents the OpenAI chat completion response
@@ -71,6 +149,8 @@ type ChatCompletionResponse struct {
 	Model   string                 `json:"model"`
 	Choices []ChatCompletionChoice `json:"choices"`
 	Usage   ChatCompletionUsage    `json:"usage"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
 }
 
 // ChatCompletionChoice represents a single choice in the response
@@ -95,6 +175,9 @@ type ChatCompletionStreamResponse struct {
 	Created int64                  `json:"created"`
 	Model   string                 `json:"model"`
 	Choices []ChatCompletionChoice `json:"choices"`
+	Usage   *ChatCompletionUsage   `json:"usage,omitempty"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
 }
 
 // ModelsResponse represents the response for /v1/models endpoint
@@ -105,10 +188,30 @@ type ModelsResponse struct {
 
 // Model represents a single model in the models list
 type Model struct {
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int64  `json:"created"`
-	OwnedBy string `json:"owned_by"`
+	ID              string             `json:"id"`
+	Object          string             `json:"object"`
+	Created         int64              `json:"created"`
+	OwnedBy         string             `json:"owned_by"`
+	ContextWindow   int                `json:"context_window,omitempty"`
+	MaxOutputTokens int                `json:"max_output_tokens,omitempty"`
+	Capabilities    *ModelCapabilities `json:"capabilities,omitempty"`
+}
+
+// ModelCapabilities describes optional features supported by a model
+type ModelCapabilities struct {
+	Vision bool `json:"vision"`
+	Tools  bool `json:"tools"`
+}
+
+// ModelInfo holds static metadata about a supported model
+type ModelInfo struct {
+	ContextWindow   int
+	MaxOutputTokens int
+	Capabilities    ModelCapabilities
+
+	// Optional request parameters the upstream accepts for this model
+	// (e.g. "temperature", "top_p"); nil accepts all of them
+	SupportedParams []string
 }
 
 // Atlassian API structures
@@ -121,9 +224,15 @@ type AtlassianRequest struct {
 
 // AtlassianRequestPayload represents the payload part of Atlassian request
 type AtlassianRequestPayload struct {
-	Messages    []ChatMessage `json:"messages"`
-	Temperature *float64      `json:"temperature,omitempty"`
-	Stream      bool          `json:"stream,omitempty"`
+	Messages       []ChatMessage      `json:"messages"`
+	Temperature    *float64           `json:"temperature,omitempty"`
+	TopP           *float64           `json:"top_p,omitempty"`
+	MaxTokens      *int               `json:"max_tokens,omitempty"`
+	Stream         bool               `json:"stream,omitempty"`
+	ResponseFormat *ResponseFormat    `json:"response_format,omitempty"`
+	Stop           []string           `json:"stop,omitempty"`
+	LogitBias      map[string]float64 `json:"logit_bias,omitempty"`
+	Tools          []Tool             `json:"tools,omitempty"`
 }
 
 // AtlassianPlatformAttrs represents platform attributes for Atlassian API
@@ -135,6 +244,25 @@ type AtlassianPlatformAttrs struct {
 type AtlassianResponse struct {
 	ResponsePayload    AtlassianResponsePayload `json:"response_payload"`
 	PlatformAttributes AtlassianPlatformAttrs   `json:"platform_attributes"`
+	Metrics            *AtlassianMetrics        `json:"metrics,omitempty"`
+	Error              *AtlassianError          `json:"error,omitempty"`
+}
+
+// AtlassianError is an error the gateway sometimes embeds in a 200 response,
+// either as an object or as a bare message string
+type AtlassianError struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Status  int    `json:"status"`
+}
+
+// UnmarshalJSON accepts both the object and the bare string form
+func (e *AtlassianError) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		return json.Unmarshal(data, &e.Message)
+	}
+	type plain AtlassianError
+	return json.Unmarshal(data, (*plain)(e))
 }
 
 // AtlassianResponsePayload represents the payload part of Atlassian response
@@ -153,13 +281,28 @@ type AtlassianResponseChoice struct {
 
 // AtlassianResponseMessage represents a message in Atlassian response
 type AtlassianResponseMessage struct {
-	Role    string                    `json:"role"`
-	Content []AtlassianContentElement `json:"content"`
+	Role      string                    `json:"role"`
+	Content   []AtlassianContentElement `json:"content"`
+	ToolCalls []ToolCall                `json:"tool_calls,omitempty"`
 }
 
 // AtlassianContentElement represents a content element in Atlassian message
 type AtlassianContentElement struct {
-	Text string `json:"text"`
+	Type     string `json:"type,omitempty"`
+	Text     string `json:"text"`
+	Thinking string `json:"thinking,omitempty"`
+
+	// Tool use fields (type "tool_use" starts a call, "input_json_delta" streams its arguments)
+	Index       *int            `json:"index,omitempty"`
+	ID          string          `json:"id,omitempty"`
+	Name        string          `json:"name,omitempty"`
+	Input       json.RawMessage `json:"input,omitempty"`
+	PartialJSON string          `json:"partial_json,omitempty"`
+}
+
+// IsReasoning reports whether the element carries extended thinking content
+func (e AtlassianContentElement) IsReasoning() bool {
+	return e.Type == "thinking" || e.Type == "reasoning"
 }
 
 // AtlassianMetrics represents usage metrics from Atlassian
@@ -169,5 +312,7 @@ type AtlassianMetrics struct {
 
 // AtlassianStreamChunk represents a streaming chunk from Atlassian
 type AtlassianStreamChunk struct {
-	ResponsePayload AtlassianResponsePayload `json:"response_payload"`
+	ResponsePayload    AtlassianResponsePayload `json:"response_payload"`
+	PlatformAttributes AtlassianPlatformAttrs   `json:"platform_attributes"`
+	Metrics            *AtlassianMetrics        `json:"metrics,omitempty"`
 }
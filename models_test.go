@@ -0,0 +1,115 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestToOpenAIRequestJSONMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		format     *ResponseFormat
+		wantInject bool
+	}{
+		{"no response_format", nil, false},
+		{"text", &ResponseFormat{Type: "text"}, false},
+		{"json_object", &ResponseFormat{Type: "json_object"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := ChatCompletionRequest{
+				Model:          testModel,
+				Messages:       []ChatMessage{{Role: "user", Content: "hi"}},
+				ResponseFormat: tt.format,
+			}
+			out, err := req.ToOpenAIRequest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantLen := 1
+			if tt.wantInject {
+				wantLen = 2
+			}
+			if len(out.Messages) != wantLen {
+				t.Fatalf("got %d messages, want %d", len(out.Messages), wantLen)
+			}
+			if tt.wantInject {
+				first := out.Messages[0]
+				if first.Role != "system" || first.Content != JSONModeInstruction {
+					t.Errorf("first message = %+v, want the JSON mode instruction", first)
+				}
+			}
+			if last := out.Messages[len(out.Messages)-1]; last.Role != "user" || last.Content != "hi" {
+				t.Errorf("user message = %+v, want it kept last", last)
+			}
+		})
+	}
+}
+
+func TestToOpenAIRequestContentTypes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content interface{}
+		want    string
+		wantErr string
+	}{
+		{"string", "hello", "hello", ""},
+		{"text parts", []interface{}{
+			map[string]interface{}{"type": "text", "text": "hello "},
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "x"}},
+			map[string]interface{}{"type": "text", "text": "world"},
+		}, "hello world", ""},
+		{"typed parts", []Content{{Type: "text", Text: "a"}, {Type: "text", Text: "b"}}, "ab", ""},
+		{"null", nil, "", ""},
+		{"number", 42.0, "42", ""},
+		{"bool", true, "true", ""},
+		{"object", map[string]interface{}{"text": "hi"}, "", "messages[1].content has unsupported type map[string]interface {}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := ChatCompletionRequest{Messages: []ChatMessage{
+				{Role: "system", Content: "be brief"},
+				{Role: "user", Content: tt.content},
+			}}
+
+			out, err := req.ToOpenAIRequest()
+
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.Messages[1].Content; got != tt.want {
+				t.Errorf("content = %#v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToOpenAIRequestKeepsOptionalFields(t *testing.T) {
+	zero, maxTokens := 0.0, 10
+	req := ChatCompletionRequest{
+		Model:       testModel,
+		Messages:    []ChatMessage{{Role: "user", Content: "hi"}},
+		Temperature: &zero,
+		TopP:        &zero,
+		MaxTokens:   &maxTokens,
+		Stop:        []string{"END"},
+		Stream:      true,
+	}
+
+	out, err := req.ToOpenAIRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Messages = req.Messages
+	if !reflect.DeepEqual(out, req) {
+		t.Errorf("ToOpenAIRequest() = %+v, want the optional fields of %+v kept", out, req)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import "strings"
+
+// reasoningTagFilter separates <tag>...</tag> blocks (e.g. <thinking>) from
+// content text. It is fed text incrementally, so a tag split across streamed
+// chunks is recognized: a trailing fragment that could start a tag is held
+// back until the next call.
+type reasoningTagFilter struct {
+	open, close string
+	inside      bool
+	pending     string
+}
+
+// newReasoningTagFilter returns a filter for REASONING_TAG, or nil when
+// REASONING_TAG_MODE leaves content untouched
+func newReasoningTagFilter() *reasoningTagFilter {
+	if ReasoningTagMode != "strip" && ReasoningTagMode != "reasoning" {
+		return nil
+	}
+	return &reasoningTagFilter{
+		open:  "<" + ReasoningTag + ">",
+		close: "</" + ReasoningTag + ">",
+	}
+}
+
+// Feed consumes the next piece of content and returns the text outside and
+// inside tagged blocks that can be emitted so far
+func (f *reasoningTagFilter) Feed(s string) (visible, reasoning string) {
+	s = f.pending + s
+	f.pending = ""
+
+	var out, in strings.Builder
+	emit := func(text string) {
+		if f.inside {
+			in.WriteString(text)
+		} else {
+			out.WriteString(text)
+		}
+	}
+
+	for s != "" {
+		tag := f.open
+		if f.inside {
+			tag = f.close
+		}
+		if i := strings.Index(s, tag); i >= 0 {
+			emit(s[:i])
+			s = s[i+len(tag):]
+			f.inside = !f.inside
+			continue
+		}
+
+		keep := partialTagSuffix(s, tag)
+		emit(s[:len(s)-keep])
+		f.pending = s[len(s)-keep:]
+		break
+	}
+
+	return out.String(), in.String()
+}
+
+// Flush returns any held-back text once no more content will arrive
+func (f *reasoningTagFilter) Flush() (visible, reasoning string) {
+	text := f.pending
+	f.pending = ""
+	if f.inside {
+		return "", text
+	}
+	return text, ""
+}
+
+// apply feeds text through the filter and returns the content to show and,
+// in "reasoning" mode, the text to report as reasoning_content
+func (f *reasoningTagFilter) apply(text string, flush bool) (content, reasoning string) {
+	content, reasoning = f.Feed(text)
+	if flush {
+		restContent, restReasoning := f.Flush()
+		content += restContent
+		reasoning += restReasoning
+	}
+	if ReasoningTagMode != "reasoning" {
+		reasoning = ""
+	}
+	return content, reasoning
+}
+
+// partialTagSuffix returns the length of the longest suffix of s that is a
+// proper prefix of tag
+func partialTagSuffix(s, tag string) int {
+	for n := min(len(s), len(tag)-1); n > 0; n-- {
+		if strings.HasSuffix(s, tag[:n]) {
+			return n
+		}
+	}
+	return 0
+}
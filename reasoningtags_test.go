@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReasoningTagFilter(t *testing.T) {
+	tests := []struct {
+		name          string
+		chunks        []string
+		wantVisible   string
+		wantReasoning string
+	}{
+		{"complete block", []string{"<thinking>plan</thinking>Answer"}, "Answer", "plan"},
+		{"no block", []string{"plain ", "text"}, "plain text", ""},
+		{"tag split across chunks", []string{"Hi <thi", "nking>plan</thin", "king> there"}, "Hi  there", "plan"},
+		{"held-back text that is not a tag", []string{"a <b", "> c"}, "a <b> c", ""},
+		{"trailing partial tag released on flush", []string{"x <thin"}, "x <thin", ""},
+		{"unclosed block", []string{"Hi <thinking>still going"}, "Hi ", "still going"},
+		{"several blocks", []string{"<thinking>a</thinking>1<thinking>b</thinking>2"}, "12", "ab"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &reasoningTagFilter{open: "<thinking>", close: "</thinking>"}
+			var visible, reasoning strings.Builder
+			for _, chunk := range tt.chunks {
+				v, r := f.Feed(chunk)
+				visible.WriteString(v)
+				reasoning.WriteString(r)
+			}
+			v, r := f.Flush()
+			visible.WriteString(v)
+			reasoning.WriteString(r)
+
+			if visible.String() != tt.wantVisible || reasoning.String() != tt.wantReasoning {
+				t.Errorf("got visible %q reasoning %q, want %q and %q", visible.String(), reasoning.String(), tt.wantVisible, tt.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestReasoningTagModes(t *testing.T) {
+	const text = "<thinking>plan</thinking>Answer"
+	tests := []struct {
+		mode          string
+		wantContent   string
+		wantReasoning string
+	}{
+		{"", text, ""},
+		{"strip", "Answer", ""},
+		{"reasoning", "Answer", "plan"},
+	}
+	for _, tt := range tests {
+		t.Run("mode="+tt.mode, func(t *testing.T) {
+			setValue(t, &ReasoningTagMode, tt.mode)
+
+			t.Run("non-streaming", func(t *testing.T) {
+				var resp AtlassianResponse
+				if err := json.Unmarshal([]byte(upstreamCompletion(textElement(text))), &resp); err != nil {
+					t.Fatal(err)
+				}
+
+				msg := ToOpenAI(resp, testModel).Choices[0].Message
+
+				if msg.Content != tt.wantContent || msg.ReasoningContent != tt.wantReasoning {
+					t.Errorf("content %q reasoning %q, want %q and %q", msg.Content, msg.ReasoningContent, tt.wantContent, tt.wantReasoning)
+				}
+			})
+
+			t.Run("streaming", func(t *testing.T) {
+				useCredentials(t, testCredentials(1)...)
+				sr := openStream(t, func(*http.Request) (*http.Response, error) {
+					body := sseFrame("", textElement("<thinking>pl")) +
+						sseFrame("", textElement("an</think")) +
+						sseFrame("end_turn", textElement("ing>Answer"))
+					return sseResponse(io.NopCloser(strings.NewReader(body))), nil
+				})
+
+				lines, err := drainStream(sr.ConvertToOpenAIStream(context.Background()))
+
+				if err != nil {
+					t.Fatal(err)
+				}
+				var content, reasoning strings.Builder
+				for _, line := range lines {
+					for _, chunk := range streamChunks(t, line) {
+						for _, choice := range chunk.Choices {
+							if choice.Delta != nil {
+								text, _ := choice.Delta.Content.(string)
+								content.WriteString(text)
+								reasoning.WriteString(choice.Delta.ReasoningContent)
+							}
+						}
+					}
+				}
+				if content.String() != tt.wantContent || reasoning.String() != tt.wantReasoning {
+					t.Errorf("content %q reasoning %q, want %q and %q", content.String(), reasoning.String(), tt.wantContent, tt.wantReasoning)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Headers whose values carry credentials and must never be written to disk
+var redactedHeaders = map[string]bool{
+	"Authorization":            true,
+	"X-Atlassian-EncodedToken": true,
+}
+
+var (
+	debugRecordSeq   atomic.Uint64
+	debugRecordPrune sync.Mutex
+)
+
+// debugRecord captures one upstream request/response exchange to a file
+type debugRecord struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// newDebugRecord starts a capture file for an outbound request. It returns nil
+// when recording is disabled or the file cannot be created.
+func newDebugRecord(body AtlassianRequest, headers map[string]string) *debugRecord {
+	if DebugRecordDir == "" {
+		return nil
+	}
+
+	// Captures hold full prompts and responses, so only the owner may read them
+	if err := os.MkdirAll(DebugRecordDir, 0700); err != nil {
+		log.Printf("Failed to create debug record directory: %v", err)
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%06d.log", time.Now().Format("20060102-150405.000"), debugRecordSeq.Add(1))
+	file, err := os.OpenFile(filepath.Join(DebugRecordDir, name), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0600)
+	if err != nil {
+		log.Printf("Failed to create debug record file: %v", err)
+		return nil
+	}
+	pruneDebugRecords()
+
+	safeHeaders := make(map[string]string, len(headers))
+	for key, value := range headers {
+		if redactedHeaders[key] {
+			value = "[REDACTED]"
+		}
+		safeHeaders[key] = value
+	}
+
+	headerBytes, _ := json.MarshalIndent(safeHeaders, "", "  ")
+	bodyBytes, _ := json.MarshalIndent(body, "", "  ")
+	fmt.Fprintf(file, "=== REQUEST POST %s\n%s\n%s\n", AtlassianAPIEndpoint, headerBytes, bodyBytes)
+
+	return &debugRecord{file: file}
+}
+
+// WriteError records a transport error and closes the record
+func (r *debugRecord) WriteError(err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.file, "=== ERROR\n%v\n", err)
+	r.file.Close()
+}
+
+// WriteResponse records a complete response body and closes the record
+func (r *debugRecord) WriteResponse(status int, body []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.file, "=== RESPONSE %d\n%s\n", status, body)
+	r.file.Close()
+}
+
+// TeeBody wraps a streaming response body so that everything read from it is
+// also written to the record. The record is closed when the body is closed.
+func (r *debugRecord) TeeBody(status int, body io.ReadCloser) io.ReadCloser {
+	if r == nil {
+		return body
+	}
+	fmt.Fprintf(r.file, "=== RESPONSE %d (stream)\n", status)
+	return &teeReadCloser{record: r, body: body}
+}
+
+type teeReadCloser struct {
+	record *debugRecord
+	body   io.ReadCloser
+	once   sync.Once
+}
+
+func (t *teeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if n > 0 {
+		t.record.mu.Lock()
+		t.record.file.Write(p[:n])
+		t.record.mu.Unlock()
+	}
+	return n, err
+}
+
+func (t *teeReadCloser) Close() error {
+	err := t.body.Close()
+	t.once.Do(func() {
+		t.record.mu.Lock()
+		t.record.file.Close()
+		t.record.mu.Unlock()
+	})
+	return err
+}
+
+// pruneDebugRecords keeps only the newest DebugRecordMaxFiles capture files
+// (0 or less = keep them all)
+func pruneDebugRecords() {
+	if DebugRecordMaxFiles <= 0 {
+		return
+	}
+
+	debugRecordPrune.Lock()
+	defer debugRecordPrune.Unlock()
+
+	files, err := filepath.Glob(filepath.Join(DebugRecordDir, "*.log"))
+	if err != nil || len(files) <= DebugRecordMaxFiles {
+		return
+	}
+
+	// File names start with a timestamp, so lexical order is chronological
+	sort.Strings(files)
+	for _, f := range files[:len(files)-DebugRecordMaxFiles] {
+		os.Remove(f)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDebugRecord(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(r *debugRecord)
+		want  []string
+	}{
+		{"response", func(r *debugRecord) { r.WriteResponse(200, []byte(`{"ok":true}`)) },
+			[]string{"=== RESPONSE 200", `{"ok":true}`}},
+		{"transport error", func(r *debugRecord) { r.WriteError(errors.New("connection reset")) },
+			[]string{"=== ERROR", "connection reset"}},
+		{"stream", func(r *debugRecord) {
+			body := r.TeeBody(200, io.NopCloser(strings.NewReader("data: chunk\n\n")))
+			io.ReadAll(body)
+			body.Close()
+		}, []string{"=== RESPONSE 200 (stream)", "data: chunk"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			setValue(t, &DebugRecordDir, dir)
+
+			r := newDebugRecord(upstreamRequest(), AuthHeaders("me@example.com", "secret-token"))
+			if r == nil {
+				t.Fatal("no record created")
+			}
+			tt.write(r)
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+			if len(files) != 1 {
+				t.Fatalf("got %d record files, want 1", len(files))
+			}
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(data)
+			for _, want := range append(tt.want, "=== REQUEST POST", "[REDACTED]") {
+				if !strings.Contains(got, want) {
+					t.Errorf("record lacks %q:\n%s", want, got)
+				}
+			}
+			if encoded := AuthHeaders("me@example.com", "secret-token")["X-Atlassian-EncodedToken"]; strings.Contains(got, encoded) {
+				t.Errorf("record leaks the credential:\n%s", got)
+			}
+		})
+	}
+}
+
+func TestDebugRecordLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		enabled   bool
+		maxFiles  int
+		records   int
+		wantFiles int
+	}{
+		{"disabled", false, 10, 3, 0},
+		{"under the cap", true, 10, 3, 3},
+		{"oldest pruned", true, 2, 5, 2},
+		{"zero keeps all", true, 0, 3, 3},
+		{"negative keeps all", true, -1, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.enabled {
+				setValue(t, &DebugRecordDir, dir)
+			} else {
+				setValue(t, &DebugRecordDir, "")
+			}
+			setValue(t, &DebugRecordMaxFiles, tt.maxFiles)
+
+			for range tt.records {
+				if r := newDebugRecord(upstreamRequest(), nil); r != nil {
+					r.WriteResponse(200, nil)
+				}
+			}
+
+			files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+			if len(files) != tt.wantFiles {
+				t.Errorf("got %d record files, want %d", len(files), tt.wantFiles)
+			}
+		})
+	}
+}
+
+func TestDebugRecordPermissions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "records")
+	setValue(t, &DebugRecordDir, dir)
+
+	r := newDebugRecord(upstreamRequest(), nil)
+	if r == nil {
+		t.Fatal("no record created")
+	}
+	r.WriteResponse(200, []byte(`{}`))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+	if len(files) != 1 {
+		t.Fatalf("got %d record files, want 1", len(files))
+	}
+	for path, want := range map[string]os.FileMode{dir: 0700, files[0]: 0600} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("%s mode = %v, want %v", filepath.Base(path), got, want)
+		}
+	}
+}
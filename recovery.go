@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"atlassian/auth"
+	"atlassian/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+// issueRecoveryToken creates a single-use password recovery token valid for
+// RECOVERY_TOKEN_TTL. Only its hash is stored.
+func issueRecoveryToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := db.CreateRecoveryToken(hashRecoveryToken(token), time.Now().Add(RecoveryTokenTTL)); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// hashRecoveryToken returns the hex SHA-256 of a recovery token
+func hashRecoveryToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ShowRecoverPage displays the form for resetting the password with a recovery token
+func ShowRecoverPage(c *gin.Context) {
+	c.HTML(http.StatusOK, "recover.html", gin.H{
+		"title": "Password Recovery",
+	})
+}
+
+// RecoverPassword consumes a recovery token and resets the admin password to a
+// new random initial password, which must be changed after logging in
+func RecoverPassword(c *gin.Context) {
+	token := c.PostForm("token")
+	if token == "" {
+		c.HTML(http.StatusBadRequest, "recover.html", gin.H{
+			"title": "Password Recovery",
+			"error": "Recovery token cannot be empty",
+		})
+		return
+	}
+
+	if err := db.ConsumeRecoveryToken(hashRecoveryToken(token)); err != nil {
+		status := http.StatusBadRequest
+		msg := strings.ToUpper(err.Error()[:1]) + err.Error()[1:]
+		if !errors.Is(err, db.ErrRecoveryTokenInvalid) && !errors.Is(err, db.ErrRecoveryTokenExpired) &&
+			!errors.Is(err, db.ErrRecoveryTokenUsed) {
+			status = http.StatusInternalServerError
+			msg = "Failed to check recovery token: " + err.Error()
+		}
+		recordAudit(c, "password.recover.failed", "")
+		c.HTML(status, "recover.html", gin.H{
+			"title": "Password Recovery",
+			"error": msg,
+		})
+		return
+	}
+
+	newPassword := db.GenerateRandomPassword(12)
+	if err := db.SetAdminPassword(auth.HashPassword(newPassword), true); err != nil {
+		c.HTML(http.StatusInternalServerError, "error.html", gin.H{
+			"error": "Failed to reset password: " + err.Error(),
+		})
+		return
+	}
+
+	recordAudit(c, "password.recover", "")
+	clearAdminCookie(c)
+
+	c.HTML(http.StatusOK, "password_reset_success.html", gin.H{
+		"title":    "Password Reset",
+		"password": newPassword,
+	})
+}
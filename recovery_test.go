@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"atlassian/auth"
+	"atlassian/db"
+)
+
+func TestRecoverPassword(t *testing.T) {
+	if err := db.SetAdminPassword(auth.HashPassword("forgotten"), false); err != nil {
+		t.Fatal(err)
+	}
+	token, err := issueRecoveryToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	submit := func(token string) (int, string) {
+		w := serve(http.MethodPost, "/admin/recover", url.Values{"token": {token}}.Encode(),
+			http.Header{"Content-Type": {"application/x-www-form-urlencoded"}})
+		return w.Code, w.Body.String()
+	}
+
+	if code, body := submit(token); code != http.StatusOK {
+		t.Fatalf("status = %d, want 200; body %s", code, body)
+	}
+	hash, initial, err := db.GetAdminPassword()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !initial || auth.VerifyPassword(hash, "forgotten") {
+		t.Errorf("password initial = %v, old password still valid = %v; want a new initial password",
+			initial, auth.VerifyPassword(hash, "forgotten"))
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantCode int
+		wantMsg  string
+	}{
+		{"reused token", token, http.StatusBadRequest, "already been used"},
+		{"unknown token", strings.Repeat("0", 64), http.StatusBadRequest, "invalid"},
+		{"empty token", "", http.StatusBadRequest, "cannot be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := submit(tt.token)
+			if code != tt.wantCode || !strings.Contains(body, tt.wantMsg) {
+				t.Errorf("status = %d, want %d with %q; body %s", code, tt.wantCode, tt.wantMsg, body)
+			}
+		})
+	}
+}
+
+func TestHashRecoveryToken(t *testing.T) {
+	if got := hashRecoveryToken("token"); got != "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0" {
+		t.Errorf("hashRecoveryToken() = %s", got)
+	}
+}
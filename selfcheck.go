@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"atlassian/auth"
+)
+
+// RunStartupSelfCheck validates configuration and upstream reachability,
+// logging a pass/fail line per check. It returns false if any check failed.
+func RunStartupSelfCheck() bool {
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			ok = false
+			log.Printf("❌ Self-check %s: %v", name, err)
+			return
+		}
+		log.Printf("✅ Self-check %s: passed", name)
+	}
+
+	report("config", checkRequiredEnv())
+	report("gateway", checkGateway())
+
+	return ok
+}
+
+// checkRequiredEnv verifies that production settings are provided
+func checkRequiredEnv() error {
+	required := []string{"JWT_SECRET", "DATABASE_URL"}
+	if auth.Algorithm() == "RS256" {
+		required[0] = "JWT_PRIVATE_KEY_FILE"
+	}
+
+	var missing []string
+	for _, key := range required {
+		if os.Getenv(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing environment variables: %v", missing)
+	}
+	return nil
+}
+
+// checkGateway sends a minimal request to the gateway with the first credential
+func checkGateway() error {
+	credentials := loadedCredentials()
+	if len(credentials) == 0 {
+		return fmt.Errorf("no credentials configured")
+	}
+	if len(SupportedModels) == 0 {
+		return fmt.Errorf("no supported models configured")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	cred := credentials[0]
+	status, err := probeCredential(ctx, cred)
+	if err != nil {
+		return fmt.Errorf("gateway unreachable: %w", err)
+	}
+	if status >= 400 {
+		return fmt.Errorf("gateway returned status %d for credential %s", status, cred.Email)
+	}
+	return nil
+}
+
+// probeCredential sends a minimal chat request with the credential and returns the gateway status
+func probeCredential(ctx context.Context, cred Credential) (int, error) {
+	// Probe with a model the credential is allowed to serve
+	model := SupportedModels[0]
+	if len(cred.Models) > 0 {
+		model = cred.Models[0]
+	}
+
+	// Only the status matters, so keep the reply as short as the gateway allows
+	maxTokens := 1
+	body := AtlassianRequest{
+		RequestPayload: AtlassianRequestPayload{
+			Messages:  []ChatMessage{{Role: "user", Content: "ping"}},
+			MaxTokens: &maxTokens,
+		},
+		PlatformAttributes: AtlassianPlatformAttrs{
+			Model: TransformModelID(model),
+		},
+	}
+
+	req := SharedHTTPClient().client.R().
+		SetContext(ctx).
+		SetHeaders(AuthHeaders(cred.Email, cred.Token)).
+		SetBody(body)
+
+	resp, err := req.Post(AtlassianAPIEndpoint)
+	if err != nil {
+		return 0, err
+	}
+	return resp.StatusCode(), nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestCheckRequiredEnv(t *testing.T) {
+	tests := []struct {
+		name        string
+		jwtSecret   string
+		databaseURL string
+		wantErr     bool
+	}{
+		{"all set", "secret", "postgres://db", false},
+		{"missing JWT_SECRET", "", "postgres://db", true},
+		{"missing DATABASE_URL", "secret", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SECRET", tt.jwtSecret)
+			t.Setenv("DATABASE_URL", tt.databaseURL)
+			if err := checkRequiredEnv(); (err != nil) != tt.wantErr {
+				t.Errorf("checkRequiredEnv() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunStartupSelfCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		creds    int
+		status   int
+		transErr error
+		want     bool
+	}{
+		{"gateway accepts the credential", 1, http.StatusOK, nil, true},
+		{"gateway rejects the credential", 1, http.StatusUnauthorized, nil, false},
+		{"gateway unreachable", 1, 0, errors.New("dial tcp: connection refused"), false},
+		{"no credentials", 0, http.StatusOK, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("JWT_SECRET", "secret")
+			t.Setenv("DATABASE_URL", "postgres://db")
+			useCredentials(t, testCredentials(tt.creds)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				if tt.transErr != nil {
+					return nil, tt.transErr
+				}
+				return jsonResponse(tt.status, upstreamCompletion(textElement("pong"))), nil
+			})
+
+			if got := RunStartupSelfCheck(); got != tt.want {
+				t.Errorf("RunStartupSelfCheck() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProbeCredential(t *testing.T) {
+	setValue(t, &SupportedModels, []string{testModel})
+	var got AtlassianRequest
+	useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		got = decodeUpstream(t, r)
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("pong"))), nil
+	})
+
+	status, err := probeCredential(context.Background(), testCredentials(1)[0])
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("probeCredential() = %d, %v, want 200", status, err)
+	}
+	if got.RequestPayload.MaxTokens == nil || *got.RequestPayload.MaxTokens != 1 {
+		t.Errorf("probe max_tokens = %v, want 1", got.RequestPayload.MaxTokens)
+	}
+	if got.PlatformAttributes.Model != TransformModelID(testModel) {
+		t.Errorf("probe model = %q, want %q", got.PlatformAttributes.Model, TransformModelID(testModel))
+	}
+}
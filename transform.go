@@ -1,10 +1,30 @@
 package main
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// systemFingerprint identifies the backend configuration that served a
+// response, so clients can notice when it changes. It is derived from the
+// upstream model reported by the gateway, falling back to the model requested,
+// and is stable for as long as that model is.
+func systemFingerprint(modelID, upstreamModel string) string {
+	backend := upstreamModel
+	if backend == "" {
+		backend = TransformModelID(modelID)
+	}
+	sum := sha256.Sum256([]byte(backend))
+	return "fp_" + hex.EncodeToString(sum[:])[:10]
+}
+
 // TransformModelID removes vendor prefix (e.g. "anthropic:")
 func TransformModelID(modelID string) string {
 	parts := strings.Split(modelID, ":")
@@ -12,33 +32,32 @@ func TransformModelID(modelID string) string {
 }
 
 func ToOpenAI(atlasResp AtlassianResponse, modelID string) ChatCompletionResponse {
-
+	// Token counts come from the gateway's metrics, when it reports them
 	var usage ChatCompletionUsage
-	if atlasResp.PlatformAttributes.Model != "" {
-
-		usage = ChatCompletionUsage{
-			PromptTokens:     nil,
-			CompletionTokens: nil,
-			TotalTokens:      nil,
-		}
+	if atlasResp.Metrics != nil {
+		usage = atlasResp.Metrics.Usage
 	}
 
 	// Convert choices
 	choices := make([]ChatCompletionChoice, len(atlasResp.ResponsePayload.Choices))
 	for i, choice := range atlasResp.ResponsePayload.Choices {
-		// Extract text content from the first content element
-		var content string
-		if len(choice.Message.Content) > 0 {
-			content = choice.Message.Content[0].Text
+		// Split text from thinking blocks, as the stream path does
+		content, reasoning := splitContentElements(choice.Message.Content)
+		if filter := newReasoningTagFilter(); filter != nil {
+			var tagged string
+			content, tagged = filter.apply(content, true)
+			reasoning += tagged
 		}
 
 		choices[i] = ChatCompletionChoice{
 			Index: choice.Index,
 			Message: &ChatMessage{
-				Role:    choice.Message.Role,
-				Content: content,
+				Role:             choice.Message.Role,
+				Content:          content,
+				ReasoningContent: reasoning,
+				ToolCalls:        extractToolCalls(choice.Message),
 			},
-			FinishReason: choice.FinishReason,
+			FinishReason: completedFinishReason(choice.FinishReason),
 		}
 	}
 
@@ -46,9 +65,43 @@ func ToOpenAI(atlasResp AtlassianResponse, modelID string) ChatCompletionRespons
 		ID:      atlasResp.ResponsePayload.ID,
 		Object:  "chat.completion",
 		Created: atlasResp.ResponsePayload.Created,
-		Model:   modelID,
+		Model:   responseModelName(modelID),
 		Choices: choices,
 		Usage:   usage,
+
+		SystemFingerprint: systemFingerprint(modelID, atlasResp.PlatformAttributes.Model),
+	}
+}
+
+// contentParts mirrors the gateway's content elements as OpenAI content parts,
+// leaving tool calls to the tool_calls field
+func contentParts(elements []AtlassianContentElement) []Content {
+	parts := []Content{}
+	for _, e := range elements {
+		switch {
+		case e.Type == "tool_use" || e.Type == "input_json_delta":
+			continue
+		case e.IsReasoning():
+			text := e.Thinking
+			if text == "" {
+				text = e.Text
+			}
+			parts = append(parts, Content{Type: "thinking", Text: text})
+		case e.Type == "":
+			parts = append(parts, Content{Type: "text", Text: e.Text})
+		default:
+			parts = append(parts, Content{Type: e.Type, Text: e.Text})
+		}
+	}
+	return parts
+}
+
+// withStructuredContent replaces each choice's string content with content parts
+func withStructuredContent(resp *ChatCompletionResponse, atlasResp AtlassianResponse) {
+	for i, choice := range atlasResp.ResponsePayload.Choices {
+		if i < len(resp.Choices) && resp.Choices[i].Message != nil {
+			resp.Choices[i].Message.Content = contentParts(choice.Message.Content)
+		}
 	}
 }
 
@@ -66,17 +119,20 @@ func ToOpenAIStreamChunk(atlasChunk AtlassianStreamChunk, requestedModel string)
 			delta.Role = choice.Message.Role
 		}
 
-		// Extract text content
-		if len(choice.Message.Content) > 0 && choice.Message.Content[0].Text != "" {
-			delta.Content = choice.Message.Content[0].Text
+		// Extract text and reasoning content
+		text, reasoning := splitContentElements(choice.Message.Content)
+		if text != "" {
+			delta.Content = text
 		}
+		delta.ReasoningContent = reasoning
+		delta.ToolCalls = extractToolCalls(choice.Message)
 
 		// Only add choice if there's meaningful content or finish reason
-		if delta.Role != "" || delta.Content != "" || choice.FinishReason != nil {
+		if delta.Role != "" || delta.Content != "" || delta.ReasoningContent != "" || len(delta.ToolCalls) > 0 || choice.FinishReason != nil {
 			choices = append(choices, ChatCompletionChoice{
 				Index:        choice.Index,
 				Delta:        delta,
-				FinishReason: choice.FinishReason,
+				FinishReason: normalizeFinishReason(choice.FinishReason),
 			})
 		}
 	}
@@ -97,9 +153,359 @@ func ToOpenAIStreamChunk(atlasChunk AtlassianStreamChunk, requestedModel string)
 		ID:      id,
 		Object:  "chat.completion.chunk",
 		Created: created,
-		Model:   requestedModel,
+		Model:   responseModelName(requestedModel),
 		Choices: choices,
+
+		SystemFingerprint: systemFingerprint(requestedModel, atlasChunk.PlatformAttributes.Model),
+	}
+}
+
+// applySystemPrompt injects the configured SYSTEM_PROMPT according to SYSTEM_PROMPT_MODE
+func applySystemPrompt(messages []ChatMessage) []ChatMessage {
+	if SystemPrompt == "" {
+		return messages
+	}
+
+	hasSystem := false
+	for _, msg := range messages {
+		if msg.Role == "system" {
+			hasSystem = true
+			break
+		}
+	}
+
+	if hasSystem {
+		switch SystemPromptMode {
+		case "skip":
+			return messages
+		case "replace":
+			filtered := make([]ChatMessage, 0, len(messages))
+			for _, msg := range messages {
+				if msg.Role != "system" {
+					filtered = append(filtered, msg)
+				}
+			}
+			messages = filtered
+		}
+	}
+
+	return append([]ChatMessage{{Role: "system", Content: SystemPrompt}}, messages...)
+}
+
+// finishReasonMap maps upstream finish reasons to the OpenAI vocabulary
+var finishReasonMap = map[string]string{
+	"stop":           "stop",
+	"end_turn":       "stop",
+	"stop_sequence":  "stop",
+	"length":         "length",
+	"max_tokens":     "length",
+	"tool_calls":     "tool_calls",
+	"tool_use":       "tool_calls",
+	"function_call":  "tool_calls",
+	"content_filter": "content_filter",
+	"safety":         "content_filter",
+	"refusal":        "content_filter",
+}
+
+// normalizeFinishReason maps an upstream finish reason to the OpenAI vocabulary.
+// Nil stays nil; unknown reasons become "stop".
+func normalizeFinishReason(reason *string) *string {
+	if reason == nil {
+		return nil
+	}
+	mapped, ok := finishReasonMap[strings.ToLower(*reason)]
+	if !ok {
+		mapped = "stop"
+	}
+	return &mapped
+}
+
+// completedFinishReason normalizes the finish reason of a completed message,
+// defaulting to "stop" when the upstream omits it
+func completedFinishReason(reason *string) *string {
+	if reason == nil {
+		stop := "stop"
+		return &stop
+	}
+	return normalizeFinishReason(reason)
+}
+
+// splitContentElements separates regular text from reasoning content
+func splitContentElements(elements []AtlassianContentElement) (text, reasoning string) {
+	for _, e := range elements {
+		if e.IsReasoning() {
+			if e.Thinking != "" {
+				reasoning += e.Thinking
+			} else {
+				reasoning += e.Text
+			}
+			continue
+		}
+		text += e.Text
+	}
+	return text, reasoning
+}
+
+// extractToolCalls collects tool calls from an upstream message, accepting both
+// OpenAI-style tool_calls and tool_use / input_json_delta content elements
+func extractToolCalls(msg AtlassianResponseMessage) []ToolCall {
+	calls := append([]ToolCall(nil), msg.ToolCalls...)
+
+	for _, e := range msg.Content {
+		switch e.Type {
+		case "tool_use":
+			var args string
+			if len(e.Input) > 0 && string(e.Input) != "{}" && string(e.Input) != "null" {
+				args = string(e.Input)
+			}
+			calls = append(calls, ToolCall{
+				Index:    e.Index,
+				ID:       e.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: e.Name, Arguments: args},
+			})
+		case "input_json_delta":
+			calls = append(calls, ToolCall{
+				Index:    e.Index,
+				Function: ToolCallFunction{Arguments: e.PartialJSON},
+			})
+		}
+	}
+
+	return calls
+}
+
+// streamAggregator folds OpenAI stream chunks back into a complete response,
+// for clients that asked for JSON while requesting a stream
+type streamAggregator struct {
+	id          string
+	created     int64
+	fingerprint string
+	choices     map[int]*aggregatedChoice
+	order       []int
+}
+
+type aggregatedChoice struct {
+	role         string
+	content      strings.Builder
+	reasoning    strings.Builder
+	toolCalls    []ToolCall
+	finishReason *string
+}
+
+func newStreamAggregator() *streamAggregator {
+	return &streamAggregator{choices: make(map[int]*aggregatedChoice)}
+}
+
+// add merges one stream chunk into the aggregate
+func (a *streamAggregator) add(chunk ChatCompletionStreamResponse) {
+	if a.id == "" {
+		a.id = chunk.ID
+		a.created = chunk.Created
+	}
+	if chunk.SystemFingerprint != "" {
+		a.fingerprint = chunk.SystemFingerprint
+	}
+
+	for _, choice := range chunk.Choices {
+		agg, ok := a.choices[choice.Index]
+		if !ok {
+			agg = &aggregatedChoice{}
+			a.choices[choice.Index] = agg
+			a.order = append(a.order, choice.Index)
+		}
+		if choice.FinishReason != nil {
+			agg.finishReason = choice.FinishReason
+		}
+		delta := choice.Delta
+		if delta == nil {
+			continue
+		}
+		if delta.Role != "" {
+			agg.role = delta.Role
+		}
+		if text, ok := delta.Content.(string); ok {
+			agg.content.WriteString(text)
+		}
+		agg.reasoning.WriteString(delta.ReasoningContent)
+		for _, call := range delta.ToolCalls {
+			agg.mergeToolCall(call)
+		}
+	}
+}
+
+// mergeToolCall starts a new tool call or appends argument fragments to the one with the same index
+func (agg *aggregatedChoice) mergeToolCall(call ToolCall) {
+	for i := range agg.toolCalls {
+		existing := &agg.toolCalls[i]
+		if existing.Index != nil && call.Index != nil && *existing.Index == *call.Index {
+			if call.ID != "" {
+				existing.ID = call.ID
+			}
+			if call.Function.Name != "" {
+				existing.Function.Name = call.Function.Name
+			}
+			existing.Function.Arguments += call.Function.Arguments
+			return
+		}
+	}
+	agg.toolCalls = append(agg.toolCalls, call)
+}
+
+// response builds the complete chat completion from the merged chunks
+func (a *streamAggregator) response(model string, usage ChatCompletionUsage) ChatCompletionResponse {
+	choices := make([]ChatCompletionChoice, 0, len(a.order))
+	for _, index := range a.order {
+		agg := a.choices[index]
+		role := agg.role
+		if role == "" {
+			role = "assistant"
+		}
+		toolCalls := agg.toolCalls
+		for i := range toolCalls {
+			toolCalls[i].Index = nil
+		}
+		choices = append(choices, ChatCompletionChoice{
+			Index: index,
+			Message: &ChatMessage{
+				Role:             role,
+				Content:          agg.content.String(),
+				ReasoningContent: agg.reasoning.String(),
+				ToolCalls:        toolCalls,
+			},
+			FinishReason: completedFinishReason(agg.finishReason),
+		})
+	}
+
+	return ChatCompletionResponse{
+		ID:      a.id,
+		Object:  "chat.completion",
+		Created: a.created,
+		Model:   responseModelName(model),
+		Choices: choices,
+		Usage:   usage,
+
+		SystemFingerprint: cmp.Or(a.fingerprint, systemFingerprint(model, "")),
+	}
+}
+
+// describeForwardedParams summarizes the generation parameters of an upstream
+// payload for debug logging. Message content is reduced to counts.
+func describeForwardedParams(payload AtlassianRequestPayload) string {
+	chars := 0
+	for _, msg := range payload.Messages {
+		if s, ok := msg.Content.(string); ok {
+			chars += utf8.RuneCountInString(s)
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "temperature=%s top_p=%s max_tokens=%s",
+		formatOptional(payload.Temperature), formatOptional(payload.TopP), formatOptional(payload.MaxTokens))
+	fmt.Fprintf(&b, " stop=%q stream=%t", payload.Stop, payload.Stream)
+	if payload.ResponseFormat != nil {
+		fmt.Fprintf(&b, " response_format=%s", payload.ResponseFormat.Type)
+	}
+	if len(payload.LogitBias) > 0 {
+		fmt.Fprintf(&b, " logit_bias=%d", len(payload.LogitBias))
+	}
+	if len(payload.Tools) > 0 {
+		names := make([]string, len(payload.Tools))
+		for i, tool := range payload.Tools {
+			names[i] = tool.Function.Name
+		}
+		fmt.Fprintf(&b, " tools=%v", names)
+	}
+	fmt.Fprintf(&b, " messages=%d (%d chars)", len(payload.Messages), chars)
+	return b.String()
+}
+
+// formatOptional formats an optional parameter, or "unset" when it is absent
+func formatOptional[T int | float64](v *T) string {
+	if v == nil {
+		return "unset"
+	}
+	return fmt.Sprint(*v)
+}
+
+// filterUnsupportedParams clears optional parameters that the model's
+// SupportedParams table doesn't list, so the gateway doesn't reject the request
+func filterUnsupportedParams(payload *AtlassianRequestPayload, model string) {
+	info, ok := lookupModelInfo(model)
+	if !ok || info.SupportedParams == nil {
+		return
+	}
+
+	drop := func(param string, present bool) bool {
+		if !present || slices.Contains(info.SupportedParams, param) {
+			return false
+		}
+		if DebugMode {
+			log.Printf("Dropping parameter %s: not supported by model %s", param, model)
+		}
+		return true
+	}
+
+	if drop("temperature", payload.Temperature != nil) {
+		payload.Temperature = nil
+	}
+	if drop("top_p", payload.TopP != nil) {
+		payload.TopP = nil
+	}
+	if drop("max_tokens", payload.MaxTokens != nil) {
+		payload.MaxTokens = nil
+	}
+	if drop("stop", payload.Stop != nil) {
+		payload.Stop = nil
+	}
+	if drop("response_format", payload.ResponseFormat != nil) {
+		payload.ResponseFormat = nil
+	}
+	if drop("logit_bias", payload.LogitBias != nil) {
+		payload.LogitBias = nil
+	}
+}
+
+// estimatePromptTokens gives a rough, deliberately low token count for the
+// message text, used to reject prompts that clearly overflow the context window
+func estimatePromptTokens(messages []ChatMessage) int {
+	chars := 0
+	for _, msg := range messages {
+		if text, ok := msg.Content.(string); ok {
+			chars += utf8.RuneCountInString(text)
+		}
+	}
+	return chars / PreflightCharsPerToken
+}
+
+// normalizeStop converts the OpenAI "stop" parameter (string, array of strings
+// or null) into the string list forwarded to the gateway
+func normalizeStop(stop interface{}) ([]string, error) {
+	var sequences []string
+	switch v := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		sequences = []string{v}
+	case []interface{}:
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("stop must be a string or an array of strings")
+			}
+			sequences = append(sequences, s)
+		}
+	default:
+		return nil, fmt.Errorf("stop must be a string or an array of strings")
+	}
+
+	if len(sequences) > MaxStopSequences {
+		return nil, fmt.Errorf("stop accepts at most %d sequences, got %d", MaxStopSequences, len(sequences))
+	}
+	if len(sequences) == 0 {
+		return nil, nil
 	}
+	return sequences, nil
 }
 
 // generateChatCompletionID generates a chat completion ID similar to OpenAI format
@@ -0,0 +1,833 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestToOpenAIStreamChunkReasoning(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       []AtlassianContentElement
+		wantContent   interface{}
+		wantReasoning string
+	}{
+		{"text only", []AtlassianContentElement{textElement("hi")}, "hi", ""},
+		{"thinking field", []AtlassianContentElement{{Type: "thinking", Thinking: "hmm"}}, nil, "hmm"},
+		{"reasoning text", []AtlassianContentElement{{Type: "reasoning", Text: "let me see"}}, nil, "let me see"},
+		{"mixed", []AtlassianContentElement{{Type: "thinking", Thinking: "plan"}, textElement("answer")}, "answer", "plan"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunk := AtlassianStreamChunk{ResponsePayload: AtlassianResponsePayload{
+				Choices: []AtlassianResponseChoice{{Message: AtlassianResponseMessage{Content: tt.content}}},
+			}}
+
+			got := ToOpenAIStreamChunk(chunk, testModel)
+
+			if len(got.Choices) != 1 {
+				t.Fatalf("got %d choices, want 1", len(got.Choices))
+			}
+			delta := got.Choices[0].Delta
+			if delta.Content != tt.wantContent {
+				t.Errorf("content = %#v, want %#v", delta.Content, tt.wantContent)
+			}
+			if delta.ReasoningContent != tt.wantReasoning {
+				t.Errorf("reasoning_content = %q, want %q", delta.ReasoningContent, tt.wantReasoning)
+			}
+		})
+	}
+}
+
+func TestStreamReasoningPassthrough(t *testing.T) {
+	useCredentials(t, testCredentials(1)...)
+	useUpstream(t, func(*http.Request) (*http.Response, error) {
+		body := sseFrame("", AtlassianContentElement{Type: "thinking", Thinking: "considering"}) +
+			sseFrame("end_turn", textElement("done"))
+		return sseResponse(io.NopCloser(strings.NewReader(body))), nil
+	})
+
+	w := postChat(t, chatBody(`"stream":true`), nil)
+
+	for _, want := range []string{`"reasoning_content":"considering"`, `"content":"done"`} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("stream lacks %s:\n%s", want, w.Body.String())
+		}
+	}
+}
+
+func TestToOpenAIFinishReason(t *testing.T) {
+	tests := []struct {
+		upstream *string
+		want     string
+	}{
+		{nil, "stop"},
+		{ptr("end_turn"), "stop"},
+		{ptr("stop_sequence"), "stop"},
+		{ptr("max_tokens"), "length"},
+		{ptr("MAX_TOKENS"), "length"},
+		{ptr("tool_use"), "tool_calls"},
+		{ptr("refusal"), "content_filter"},
+		{ptr("something_new"), "stop"},
+	}
+	for _, tt := range tests {
+		name := "<nil>"
+		if tt.upstream != nil {
+			name = *tt.upstream
+		}
+		t.Run(name, func(t *testing.T) {
+			resp := ToOpenAI(AtlassianResponse{ResponsePayload: AtlassianResponsePayload{
+				Choices: []AtlassianResponseChoice{{
+					Message:      AtlassianResponseMessage{Role: "assistant", Content: []AtlassianContentElement{textElement("hi")}},
+					FinishReason: tt.upstream,
+				}},
+			}}, testModel)
+
+			if got := resp.Choices[0].FinishReason; got == nil || *got != tt.want {
+				t.Errorf("finish_reason = %v, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeFinishReasonKeepsNil(t *testing.T) {
+	if got := normalizeFinishReason(nil); got != nil {
+		t.Errorf("normalizeFinishReason(nil) = %q, want nil for stream chunks that aren't final", *got)
+	}
+}
+
+func TestStreamToolCallDeltas(t *testing.T) {
+	frames := []string{
+		sseFrame("", AtlassianContentElement{Type: "tool_use", Index: ptr(0), ID: "call_1", Name: "get_weather", Input: json.RawMessage(`{}`)}),
+		sseFrame("", AtlassianContentElement{Type: "input_json_delta", Index: ptr(0), PartialJSON: `{"city":`}),
+		sseFrame("", AtlassianContentElement{Type: "input_json_delta", Index: ptr(0), PartialJSON: `"Paris"}`}),
+		sseFrame("tool_use"),
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"streamed", nil},
+		{"aggregated for JSON clients", http.Header{"Accept": {"application/json"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return sseResponse(io.NopCloser(strings.NewReader(strings.Join(frames, "")))), nil
+			})
+
+			w := postChat(t, chatBody(`"stream":true`), tt.header)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+
+			var calls []ToolCall
+			var finish string
+			if tt.header == nil {
+				for _, chunk := range streamChunks(t, w.Body.String()) {
+					for _, choice := range chunk.Choices {
+						calls = mergeToolCallDeltas(calls, choice.Delta.ToolCalls)
+						if choice.FinishReason != nil {
+							finish = *choice.FinishReason
+						}
+					}
+				}
+			} else {
+				var resp ChatCompletionResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				calls = resp.Choices[0].Message.ToolCalls
+				finish = *resp.Choices[0].FinishReason
+			}
+
+			if len(calls) != 1 {
+				t.Fatalf("got %d tool calls, want 1: %+v", len(calls), calls)
+			}
+			got := calls[0]
+			if got.ID != "call_1" || got.Type != "function" || got.Function.Name != "get_weather" || got.Function.Arguments != `{"city":"Paris"}` {
+				t.Errorf("tool call = %+v", got)
+			}
+			if finish != "tool_calls" {
+				t.Errorf("finish_reason = %q, want tool_calls", finish)
+			}
+		})
+	}
+}
+
+// streamChunks decodes the data events of an SSE body, skipping [DONE]
+func streamChunks(t *testing.T, body string) []ChatCompletionStreamResponse {
+	t.Helper()
+	var chunks []ChatCompletionStreamResponse
+	for _, event := range strings.Split(body, "\n\n") {
+		data, ok := strings.CutPrefix(event, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk ChatCompletionStreamResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("decode chunk %q: %v", data, err)
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// mergeToolCallDeltas applies stream tool call deltas the way OpenAI clients do
+func mergeToolCallDeltas(calls []ToolCall, deltas []ToolCall) []ToolCall {
+	for _, d := range deltas {
+		i := 0
+		if d.Index != nil {
+			i = *d.Index
+		}
+		for len(calls) <= i {
+			calls = append(calls, ToolCall{})
+		}
+		calls[i].ID += d.ID
+		calls[i].Type += d.Type
+		calls[i].Function.Name += d.Function.Name
+		calls[i].Function.Arguments += d.Function.Arguments
+	}
+	return calls
+}
+
+func TestApplySystemPrompt(t *testing.T) {
+	user := ChatMessage{Role: "user", Content: "hi"}
+	clientSystem := ChatMessage{Role: "system", Content: "client"}
+	configured := ChatMessage{Role: "system", Content: "configured"}
+	tests := []struct {
+		name     string
+		prompt   string
+		mode     string
+		messages []ChatMessage
+		want     []ChatMessage
+	}{
+		{"unset", "", "prepend", []ChatMessage{user}, []ChatMessage{user}},
+		{"prepended", "configured", "prepend", []ChatMessage{user}, []ChatMessage{configured, user}},
+		{"prepended before the client's", "configured", "prepend", []ChatMessage{clientSystem, user}, []ChatMessage{configured, clientSystem, user}},
+		{"skipped when the client has one", "configured", "skip", []ChatMessage{clientSystem, user}, []ChatMessage{clientSystem, user}},
+		{"skip mode without a client prompt", "configured", "skip", []ChatMessage{user}, []ChatMessage{configured, user}},
+		{"replaces the client's", "configured", "replace", []ChatMessage{clientSystem, user}, []ChatMessage{configured, user}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &SystemPrompt, tt.prompt)
+			setValue(t, &SystemPromptMode, tt.mode)
+
+			if got := applySystemPrompt(tt.messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("applySystemPrompt() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSystemPromptForwarded(t *testing.T) {
+	setValue(t, &SystemPrompt, "configured")
+	setValue(t, &SystemPromptMode, "prepend")
+
+	w := postChat(t, chatBody(`"dry_run":true`), nil)
+
+	var payload AtlassianRequest
+	if err := json.Unmarshal(w.Body.Bytes(), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if msgs := payload.RequestPayload.Messages; len(msgs) != 2 || msgs[0].Role != "system" || msgs[0].Content != "configured" {
+		t.Errorf("forwarded messages = %+v, want the system prompt first", msgs)
+	}
+}
+
+// metricsFrame formats a gateway stream chunk that carries only usage metrics
+func metricsFrame(prompt, completion int) string {
+	total := prompt + completion
+	data, _ := json.Marshal(AtlassianStreamChunk{
+		ResponsePayload: AtlassianResponsePayload{ID: "msg_1", Created: 1700000000},
+		Metrics:         &AtlassianMetrics{Usage: ChatCompletionUsage{PromptTokens: &prompt, CompletionTokens: &completion, TotalTokens: &total}},
+	})
+	return "data: " + string(data) + "\n\n"
+}
+
+func TestStreamUsage(t *testing.T) {
+	text := sseFrame("", textElement("Hi"))
+	end := sseFrame("end_turn")
+	tests := []struct {
+		name      string
+		options   string
+		frames    []string
+		wantUsage *[3]int // nil when no usage chunk is expected
+	}{
+		{"reported when requested", `"stream_options":{"include_usage":true}`,
+			[]string{text, end, metricsFrame(12, 5)}, &[3]int{12, 5, 17}},
+		{"latest metrics win", `"stream_options":{"include_usage":true}`,
+			[]string{metricsFrame(12, 1), text, metricsFrame(12, 5), end}, &[3]int{12, 5, 17}},
+		{"omitted unless requested", `"stream_options":{"include_usage":false}`,
+			[]string{text, end, metricsFrame(12, 5)}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return sseResponse(io.NopCloser(strings.NewReader(strings.Join(tt.frames, "")))), nil
+			})
+
+			w := postChat(t, chatBody(`"stream":true,`+tt.options), nil)
+
+			if !strings.HasSuffix(w.Body.String(), "data: [DONE]\n\n") {
+				t.Fatalf("stream not terminated with [DONE]:\n%s", w.Body.String())
+			}
+			chunks := streamChunks(t, w.Body.String())
+			var usage *ChatCompletionUsage
+			for i, chunk := range chunks {
+				if chunk.Usage == nil {
+					continue
+				}
+				if i != len(chunks)-1 || len(chunk.Choices) != 0 {
+					t.Errorf("usage chunk %d of %d has %d choices, want the last chunk with none", i+1, len(chunks), len(chunk.Choices))
+				}
+				usage = chunk.Usage
+			}
+			if tt.wantUsage == nil {
+				if usage != nil {
+					t.Errorf("unexpected usage chunk: %+v", usage)
+				}
+				return
+			}
+			if usage == nil || usage.PromptTokens == nil || usage.CompletionTokens == nil || usage.TotalTokens == nil {
+				t.Fatalf("usage = %+v, want %v", usage, *tt.wantUsage)
+			}
+			if got := [3]int{*usage.PromptTokens, *usage.CompletionTokens, *usage.TotalTokens}; got != *tt.wantUsage {
+				t.Errorf("usage = %v, want %v", got, *tt.wantUsage)
+			}
+		})
+	}
+}
+
+func TestStopSequences(t *testing.T) {
+	tests := []struct {
+		name     string
+		stop     string // raw JSON value, empty to omit the field
+		wantStop []string
+		wantErr  bool
+	}{
+		{"omitted", "", nil, false},
+		{"null", `null`, nil, false},
+		{"string", `"END"`, []string{"END"}, false},
+		{"array", `["a","b"]`, []string{"a", "b"}, false},
+		{"empty array", `[]`, nil, false},
+		{"four sequences", `["1","2","3","4"]`, []string{"1", "2", "3", "4"}, false},
+		{"too many sequences", `["1","2","3","4","5"]`, nil, true},
+		{"non-string item", `["a",1]`, nil, true},
+		{"wrong type", `42`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			var got []string
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				got = decodeUpstream(t, r).RequestPayload.Stop
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+			extra := ""
+			if tt.stop != "" {
+				extra = `"stop":` + tt.stop
+			}
+
+			w := postChat(t, chatBody(extra), nil)
+
+			if tt.wantErr {
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, want 400; body %s", w.Code, w.Body.String())
+				}
+				if _, errType, param := decodeError(t, w); errType != "invalid_request_error" || param != "stop" {
+					t.Errorf("error type %q param %q, want invalid_request_error on stop", errType, param)
+				}
+				return
+			}
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			if !reflect.DeepEqual(got, tt.wantStop) {
+				t.Errorf("forwarded stop = %q, want %q", got, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestFilterUnsupportedParams(t *testing.T) {
+	metadata := maps.Clone(ModelMetadata)
+	metadata["test:temperature-only"] = ModelInfo{SupportedParams: []string{"temperature"}}
+	metadata["test:no-params"] = ModelInfo{SupportedParams: []string{}}
+	metadata["test:any-params"] = ModelInfo{}
+	setValue(t, &ModelMetadata, metadata)
+
+	full := func() AtlassianRequestPayload {
+		return AtlassianRequestPayload{
+			Temperature:    ptr(0.5),
+			TopP:           ptr(0.9),
+			MaxTokens:      ptr(100),
+			Stop:           []string{"END"},
+			ResponseFormat: &ResponseFormat{Type: "json_object"},
+		}
+	}
+	tests := []struct {
+		name  string
+		model string
+		want  func() AtlassianRequestPayload
+	}{
+		{"only listed parameters kept", "test:temperature-only", func() AtlassianRequestPayload {
+			return AtlassianRequestPayload{Temperature: ptr(0.5)}
+		}},
+		{"matched without the vendor prefix", "temperature-only", func() AtlassianRequestPayload {
+			return AtlassianRequestPayload{Temperature: ptr(0.5)}
+		}},
+		{"empty list drops everything", "test:no-params", func() AtlassianRequestPayload { return AtlassianRequestPayload{} }},
+		{"no table accepts everything", "test:any-params", full},
+		{"unknown model untouched", "test:unknown", full},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := full()
+
+			filterUnsupportedParams(&payload, tt.model)
+
+			if want := tt.want(); !reflect.DeepEqual(payload, want) {
+				t.Errorf("payload = %+v, want %+v", payload, want)
+			}
+		})
+	}
+}
+
+func TestUnsupportedParamsNotForwarded(t *testing.T) {
+	metadata := maps.Clone(ModelMetadata)
+	info := metadata[testModel]
+	info.SupportedParams = []string{"temperature", "max_tokens"}
+	metadata[testModel] = info
+	setValue(t, &ModelMetadata, metadata)
+	useCredentials(t, testCredentials(1)...)
+	var got AtlassianRequestPayload
+	useUpstream(t, func(r *http.Request) (*http.Response, error) {
+		got = decodeUpstream(t, r).RequestPayload
+		return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+	})
+
+	w := postChat(t, chatBody(`"temperature":0.5,"top_p":0.9,"max_tokens":100`), nil)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+	}
+	if got.Temperature == nil || got.MaxTokens == nil || got.TopP != nil {
+		t.Errorf("forwarded temperature=%v max_tokens=%v top_p=%v, want top_p stripped", got.Temperature, got.MaxTokens, got.TopP)
+	}
+}
+
+func TestEstimatePromptTokens(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []ChatMessage
+		want     int
+	}{
+		{"empty", nil, 0},
+		{"summed across messages", []ChatMessage{{Content: strings.Repeat("a", 60)}, {Content: strings.Repeat("b", 60)}}, 20},
+		{"counted in characters", []ChatMessage{{Content: strings.Repeat("é", 60)}}, 10},
+		{"non-text content ignored", []ChatMessage{{Content: []interface{}{map[string]interface{}{"type": "text", "text": "hi"}}}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := estimatePromptTokens(tt.messages); got != tt.want {
+				t.Errorf("estimatePromptTokens() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContextPreflight(t *testing.T) {
+	metadata := maps.Clone(ModelMetadata)
+	info := metadata[testModel]
+	info.ContextWindow = 100
+	metadata[testModel] = info
+	setValue(t, &ModelMetadata, metadata)
+
+	oversized := strings.Repeat("word ", 200) // ~166 estimated tokens
+	tests := []struct {
+		name       string
+		enabled    bool
+		content    string
+		wantReject bool
+	}{
+		{"off by default", false, oversized, false},
+		{"oversized prompt rejected", true, oversized, true},
+		{"prompt within the window", true, "hi", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &ContextPreflight, tt.enabled)
+			useCredentials(t, testCredentials(1)...)
+			called := false
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				called = true
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+			body, _ := json.Marshal(map[string]interface{}{
+				"model":    testModel,
+				"messages": []map[string]string{{"role": "user", "content": tt.content}},
+			})
+
+			w := postChat(t, string(body), nil)
+
+			if !tt.wantReject {
+				if w.Code != http.StatusOK || !called {
+					t.Errorf("status = %d, upstream called %v; want the request forwarded", w.Code, called)
+				}
+				return
+			}
+			if w.Code != http.StatusBadRequest || called {
+				t.Fatalf("status = %d, upstream called %v; want 400 before calling upstream", w.Code, called)
+			}
+			var resp struct {
+				Error struct{ Code, Type, Param string }
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Error.Code != "context_length_exceeded" || resp.Error.Type != "invalid_request_error" || resp.Error.Param != "messages" {
+				t.Errorf("error = %+v, want context_length_exceeded on messages", resp.Error)
+			}
+		})
+	}
+}
+
+func TestLogitBiasForwarding(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    []string
+		extra     string
+		wantBias  map[string]float64
+		wantField bool
+	}{
+		{"forwarded when supported", []string{"logit_bias"}, `"logit_bias":{"50256":-100}`, map[string]float64{"50256": -100}, true},
+		{"absent when omitted", []string{"logit_bias"}, "", nil, false},
+		{"dropped for Anthropic models", anthropicParams, `"logit_bias":{"50256":-100}`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metadata := maps.Clone(ModelMetadata)
+			info := metadata[testModel]
+			info.SupportedParams = tt.params
+			metadata[testModel] = info
+			setValue(t, &ModelMetadata, metadata)
+			useCredentials(t, testCredentials(1)...)
+			var raw []byte
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				raw, _ = io.ReadAll(r.Body)
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+
+			w := postChat(t, chatBody(tt.extra), nil)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			var got AtlassianRequest
+			if err := json.Unmarshal(raw, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.RequestPayload.LogitBias, tt.wantBias) {
+				t.Errorf("logit_bias = %v, want %v", got.RequestPayload.LogitBias, tt.wantBias)
+			}
+			if has := strings.Contains(string(raw), `"logit_bias"`); has != tt.wantField {
+				t.Errorf("logit_bias field present = %v, want %v; body %s", has, tt.wantField, raw)
+			}
+		})
+	}
+}
+
+func TestStructuredContent(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  interface{}
+	}{
+		{"string by default", "", "Let me check.Done."},
+		{"typed parts when requested", `"structured_content":true`, []interface{}{
+			map[string]interface{}{"type": "thinking", "text": "hmm"},
+			map[string]interface{}{"type": "text", "text": "Let me check."},
+			map[string]interface{}{"type": "text", "text": "Done."},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return jsonResponse(http.StatusOK, upstreamCompletion(
+					AtlassianContentElement{Type: "thinking", Thinking: "hmm"},
+					textElement("Let me check."),
+					AtlassianContentElement{Type: "tool_use", ID: "call_1", Name: "lookup", Input: json.RawMessage(`{}`)},
+					AtlassianContentElement{Text: "Done."},
+				)), nil
+			})
+
+			w := postChat(t, chatBody(tt.extra), nil)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Choices []struct {
+					Message struct {
+						Content interface{} `json:"content"`
+					} `json:"message"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if len(resp.Choices) != 1 {
+				t.Fatalf("got %d choices, want 1", len(resp.Choices))
+			}
+			if got := resp.Choices[0].Message.Content; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("content = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseModelNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     map[string]string
+		stream    bool
+		wantModel string
+	}{
+		{"passthrough by default", map[string]string{}, false, testModel},
+		{"renamed", map[string]string{TransformModelID(testModel): "my-assistant"}, false, "my-assistant"},
+		{"renamed in streams", map[string]string{TransformModelID(testModel): "my-assistant"}, true, "my-assistant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setValue(t, &ResponseModelNames, tt.names)
+			useCredentials(t, testCredentials(1)...)
+			var upstreamModel string
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				upstreamModel = decodeUpstream(t, r).PlatformAttributes.Model
+				if tt.stream {
+					return sseResponse(io.NopCloser(strings.NewReader(sseFrame("end_turn", textElement("ok"))))), nil
+				}
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+
+			w := postChat(t, chatBody(`"stream":`+strconv.FormatBool(tt.stream)+`,"stream_options":{"include_usage":true}`), nil)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			if upstreamModel != TransformModelID(testModel) {
+				t.Errorf("upstream model = %q, want %q", upstreamModel, TransformModelID(testModel))
+			}
+			var models []string
+			if tt.stream {
+				for _, chunk := range streamChunks(t, w.Body.String()) {
+					models = append(models, chunk.Model)
+				}
+			} else {
+				var resp ChatCompletionResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				models = append(models, resp.Model)
+			}
+			if len(models) == 0 {
+				t.Fatal("no response chunks")
+			}
+			for _, model := range models {
+				if model != tt.wantModel {
+					t.Errorf("response model = %q, want %q", model, tt.wantModel)
+				}
+			}
+		})
+	}
+}
+
+func TestDescribeForwardedParams(t *testing.T) {
+	temperature, maxTokens := 0.0, 256
+	tests := []struct {
+		name    string
+		payload AtlassianRequestPayload
+		want    string
+	}{
+		{
+			"defaults",
+			AtlassianRequestPayload{Messages: []ChatMessage{{Role: "user", Content: "hi"}}},
+			`temperature=unset top_p=unset max_tokens=unset stop=[] stream=false messages=1 (2 chars)`,
+		},
+		{
+			"all parameters",
+			AtlassianRequestPayload{
+				Messages:       []ChatMessage{{Role: "system", Content: "héllo"}, {Role: "user", Content: []interface{}{"parts"}}},
+				Temperature:    &temperature,
+				MaxTokens:      &maxTokens,
+				Stream:         true,
+				ResponseFormat: &ResponseFormat{Type: "json_object"},
+				Stop:           []string{"END"},
+				LogitBias:      map[string]float64{"1": 5, "2": -5},
+				Tools:          []Tool{{Type: "function", Function: ToolFunction{Name: "lookup"}}},
+			},
+			`temperature=0 top_p=unset max_tokens=256 stop=["END"] stream=true response_format=json_object logit_bias=2 tools=[lookup] messages=2 (5 chars)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeForwardedParams(tt.payload); got != tt.want {
+				t.Errorf("describeForwardedParams() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZeroParamsForwarded(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		want  map[string]string
+	}{
+		{"omitted", "", map[string]string{}},
+		{"temperature zero", `"temperature":0`, map[string]string{"temperature": "0"}},
+		{"top_p zero", `"top_p":0`, map[string]string{"top_p": "0"}},
+		{"both set", `"temperature":0.7,"top_p":0`, map[string]string{"temperature": "0.7", "top_p": "0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			var raw []byte
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				raw, _ = io.ReadAll(r.Body)
+				return jsonResponse(http.StatusOK, upstreamCompletion(textElement("ok"))), nil
+			})
+
+			w := postChat(t, chatBody(tt.extra), nil)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			var sent struct {
+				RequestPayload map[string]json.RawMessage `json:"request_payload"`
+			}
+			if err := json.Unmarshal(raw, &sent); err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, param := range []string{"temperature", "top_p"} {
+				if value, ok := sent.RequestPayload[param]; ok {
+					got[param] = string(value)
+				}
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("forwarded %v, want %v; body %s", got, tt.want, raw)
+			}
+		})
+	}
+}
+
+func TestSystemFingerprint(t *testing.T) {
+	tests := []struct {
+		name          string
+		model, other  string
+		upstream      string
+		otherUpstream string
+		wantEqual     bool
+	}{
+		{"vendor prefix ignored", testModel, TransformModelID(testModel), "", "", true},
+		{"upstream model wins", testModel, "anthropic:claude-3-7-sonnet@20250219", "claude-x", "claude-x", true},
+		{"different models differ", testModel, "anthropic:claude-3-7-sonnet@20250219", "", "", false},
+		{"different upstream models differ", testModel, testModel, "claude-x", "claude-y", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := systemFingerprint(tt.model, tt.upstream)
+			b := systemFingerprint(tt.other, tt.otherUpstream)
+
+			if hex, ok := strings.CutPrefix(a, "fp_"); !ok || len(hex) != 10 {
+				t.Errorf("fingerprint = %q, want fp_ and 10 hex characters", a)
+			}
+			if (a == b) != tt.wantEqual {
+				t.Errorf("fingerprints %q and %q, want equal = %v", a, b, tt.wantEqual)
+			}
+		})
+	}
+}
+
+func TestSystemFingerprintResponses(t *testing.T) {
+	const upstreamModel = "claude-sonnet-4-v2@20250601"
+	want := systemFingerprint(testModel, upstreamModel)
+	frame := func(platformModel, finishReason, text string) string {
+		chunk := AtlassianStreamChunk{
+			ResponsePayload: AtlassianResponsePayload{ID: "msg_1", Created: 1700000000, Choices: []AtlassianResponseChoice{{
+				Message: AtlassianResponseMessage{Role: "assistant", Content: []AtlassianContentElement{textElement(text)}},
+			}}},
+			PlatformAttributes: AtlassianPlatformAttrs{Model: platformModel},
+		}
+		if finishReason != "" {
+			chunk.ResponsePayload.Choices[0].FinishReason = &finishReason
+		}
+		data, _ := json.Marshal(chunk)
+		return "data: " + string(data) + "\n\n"
+	}
+	// Only the first frame names the upstream model
+	frames := frame(upstreamModel, "", "Hello") + frame("", "", " world") + frame("", "end_turn", "")
+	completion, _ := json.Marshal(AtlassianResponse{
+		ResponsePayload:    AtlassianResponsePayload{ID: "msg_1", Choices: []AtlassianResponseChoice{{Message: AtlassianResponseMessage{Role: "assistant", Content: []AtlassianContentElement{textElement("hi")}}}}},
+		PlatformAttributes: AtlassianPlatformAttrs{Model: upstreamModel},
+	})
+	tests := []struct {
+		name   string
+		extra  string
+		header http.Header
+	}{
+		{"non-streaming", "", nil},
+		{"streaming", `"stream":true`, nil},
+		{"aggregated stream", `"stream":true`, http.Header{"Accept": {"application/json"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				if tt.extra == "" {
+					return jsonResponse(http.StatusOK, string(completion)), nil
+				}
+				return sseResponse(io.NopCloser(strings.NewReader(frames))), nil
+			})
+
+			w := postChat(t, chatBody(tt.extra), tt.header)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+			}
+			var got []string
+			if strings.HasPrefix(w.Header().Get("Content-Type"), "text/event-stream") {
+				for _, chunk := range streamChunks(t, w.Body.String()) {
+					got = append(got, chunk.SystemFingerprint)
+				}
+			} else {
+				var resp ChatCompletionResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, resp.SystemFingerprint)
+			}
+			if len(got) == 0 {
+				t.Fatal("no response decoded")
+			}
+			for _, fp := range got {
+				if fp != want {
+					t.Errorf("system_fingerprint = %v, want %s on every response", got, want)
+					break
+				}
+			}
+		})
+	}
+}
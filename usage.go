@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"atlassian/db"
+)
+
+// requestLogQueue buffers request log entries for the background writer
+var requestLogQueue = make(chan db.RequestLog, 1024)
+
+var (
+	requestLogStop     = make(chan struct{}) // Closed to ask the writer to flush and exit
+	requestLogDone     = make(chan struct{}) // Closed once the writer has exited
+	requestLogStopOnce sync.Once
+)
+
+// StartRequestLogWriter starts the background goroutine that persists request
+// logs in batches, keeping database writes off the request path
+func StartRequestLogWriter() {
+	go func() {
+		defer close(requestLogDone)
+
+		ticker := time.NewTicker(2 * time.Second)
+		defer ticker.Stop()
+
+		var batch []db.RequestLog
+		flush := func() {
+			if err := db.AddRequestLogs(batch); err != nil {
+				log.Printf("Failed to write %d request logs: %v", len(batch), err)
+			}
+			batch = batch[:0]
+		}
+
+		for {
+			select {
+			case entry := <-requestLogQueue:
+				batch = append(batch, entry)
+				if len(batch) >= 100 {
+					flush()
+				}
+			case <-ticker.C:
+				flush()
+			case <-requestLogStop:
+				// Write out everything still queued before exiting
+				for {
+					select {
+					case entry := <-requestLogQueue:
+						batch = append(batch, entry)
+					default:
+						flush()
+						return
+					}
+				}
+			}
+		}
+	}()
+}
+
+// StopRequestLogWriter flushes queued request logs and waits for the writer to
+// exit. Call it once the server has stopped taking requests.
+func StopRequestLogWriter() {
+	requestLogStopOnce.Do(func() { close(requestLogStop) })
+	<-requestLogDone
+}
+
+// recordRequestLog queues a request log entry, dropping it if the queue is full
+func recordRequestLog(apiToken, model string, metadata map[string]string, usage ChatCompletionUsage, status int) {
+	entry := db.RequestLog{
+		CreatedAt:        time.Now(),
+		TokenHash:        hashAPIToken(apiToken),
+		Model:            model,
+		PromptTokens:     intValue(usage.PromptTokens),
+		CompletionTokens: intValue(usage.CompletionTokens),
+		Status:           status,
+	}
+	if len(metadata) > 0 {
+		if data, err := json.Marshal(metadata); err == nil {
+			entry.Metadata = string(data)
+		}
+	}
+
+	select {
+	case requestLogQueue <- entry:
+	default:
+		log.Printf("Request log queue full, dropping entry for model %s", model)
+	}
+}
+
+// hashAPIToken returns the hex SHA-256 of an API token so raw tokens are never stored
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func intValue(p *int) int {
+	if p == nil {
+		return 0
+	}
+	return *p
+}
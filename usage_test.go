@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"atlassian/db"
+)
+
+// startRequestLogWriter runs a fresh request log writer for one test
+func startRequestLogWriter(t *testing.T) {
+	t.Helper()
+	requestLogStop = make(chan struct{})
+	requestLogDone = make(chan struct{})
+	requestLogStopOnce = sync.Once{}
+	StartRequestLogWriter()
+	t.Cleanup(StopRequestLogWriter)
+}
+
+func TestRequestLogging(t *testing.T) {
+	tests := []struct {
+		name         string
+		body         string
+		wantStatus   int
+		wantModel    string
+		wantMetadata string
+		wantTokens   [2]int
+	}{
+		{"completion", chatBody(""), http.StatusOK, testModel, "", [2]int{12, 5}},
+		{"with metadata", chatBody(`"metadata":{"team":"search"}`), http.StatusOK, testModel, `{"team":"search"}`, [2]int{12, 5}},
+		{"streamed", chatBody(`"stream":true`), http.StatusOK, testModel, "", [2]int{12, 5}},
+		{"rejected request", chatBody(`"temperature":9`), http.StatusBadRequest, testModel, "", [2]int{}},
+		{"malformed body", `{"model":`, http.StatusBadRequest, "", "", [2]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startRequestLogWriter(t)
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(r *http.Request) (*http.Response, error) {
+				if decodeUpstream(t, r).RequestPayload.Stream {
+					frames := sseFrame("", textElement("hi")) + sseFrame("end_turn") + metricsFrame(12, 5)
+					return sseResponse(io.NopCloser(strings.NewReader(frames))), nil
+				}
+				return jsonResponse(http.StatusOK, upstreamCompletionWithUsage(12, 5, textElement("hi"))), nil
+			})
+			token := newAPIToken(t)
+
+			w := serve(http.MethodPost, "/v1/chat/completions", tt.body, http.Header{
+				"Authorization": {"Bearer " + token},
+				"Content-Type":  {"application/json"},
+			})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			// Stopping the writer flushes what is queued
+			StopRequestLogWriter()
+
+			var logs []db.RequestLog
+			if err := db.GetDB().Where("token_hash = ?", hashAPIToken(token)).Find(&logs).Error; err != nil {
+				t.Fatal(err)
+			}
+			if len(logs) != 1 {
+				t.Fatalf("got %d request logs, want 1", len(logs))
+			}
+			got := logs[0]
+			if got.Status != tt.wantStatus || got.Model != tt.wantModel || got.Metadata != tt.wantMetadata {
+				t.Errorf("log = status %d model %q metadata %q, want %d %q %q",
+					got.Status, got.Model, got.Metadata, tt.wantStatus, tt.wantModel, tt.wantMetadata)
+			}
+			if tokens := [2]int{got.PromptTokens, got.CompletionTokens}; tokens != tt.wantTokens {
+				t.Errorf("logged prompt, completion tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestHashAPIToken(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"sk-test", "f3abf2a6cc4f00987743db5f544ba345b4899ae31f326d8ee9c4816de153c9e0"},
+	}
+	for _, tt := range tests {
+		if got := hashAPIToken(tt.token); got != tt.want {
+			t.Errorf("hashAPIToken(%q) = %s, want %s", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestUsageAPI(t *testing.T) {
+	day := func(d, hour int) time.Time { return time.Date(2024, 3, d, hour, 0, 0, 0, time.UTC) }
+	seed := []db.RequestLog{
+		{CreatedAt: day(1, 9), Model: "model-a", PromptTokens: 10, CompletionTokens: 1},
+		{CreatedAt: day(1, 23), Model: "model-a", PromptTokens: 20, CompletionTokens: 2},
+		{CreatedAt: day(1, 12), Model: "model-b", PromptTokens: 5, CompletionTokens: 5},
+		{CreatedAt: day(2, 0), Model: "model-a", PromptTokens: 7, CompletionTokens: 3},
+		{CreatedAt: day(3, 8), Model: "model-b", PromptTokens: 100, CompletionTokens: 100},
+	}
+	for i := range seed {
+		seed[i].TokenHash = "usage-api-test"
+	}
+	if err := db.GetDB().Create(&seed).Error; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.GetDB().Where("token_hash = ?", "usage-api-test").Delete(&db.RequestLog{}) })
+
+	tests := []struct {
+		name     string
+		query    string
+		wantCode int
+		want     []db.ModelUsageSummary
+	}{
+		{"grouped by model and day", "?from=2024-03-01&to=2024-03-02", http.StatusOK, []db.ModelUsageSummary{
+			{Day: "2024-03-01", Model: "model-a", Requests: 2, PromptTokens: 30, CompletionTokens: 3},
+			{Day: "2024-03-01", Model: "model-b", Requests: 1, PromptTokens: 5, CompletionTokens: 5},
+			{Day: "2024-03-02", Model: "model-a", Requests: 1, PromptTokens: 7, CompletionTokens: 3},
+		}},
+		{"single day", "?from=2024-03-03&to=2024-03-03", http.StatusOK, []db.ModelUsageSummary{
+			{Day: "2024-03-03", Model: "model-b", Requests: 1, PromptTokens: 100, CompletionTokens: 100},
+		}},
+		{"empty range", "?from=2024-02-01&to=2024-02-28", http.StatusOK, []db.ModelUsageSummary{}},
+		{"malformed date", "?from=March", http.StatusBadRequest, nil},
+		{"to before from", "?from=2024-03-02&to=2024-03-01", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(http.MethodGet, "/admin/api/usage"+tt.query, "", adminHeader(t))
+
+			if w.Code != tt.wantCode {
+				t.Fatalf("status = %d, want %d; body %s", w.Code, tt.wantCode, w.Body.String())
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var resp struct {
+				Data []db.ModelUsageSummary `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(resp.Data, tt.want) {
+				t.Errorf("usage = %+v, want %+v", resp.Data, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestLoggingSkipsUnsentRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		header   http.Header
+		requests int
+		wantLogs int
+	}{
+		{"dry run", chatBody(`"dry_run":true`), nil, 1, 0},
+		{"dry run header", chatBody(""), http.Header{"X-Dry-Run": {"true"}}, 1, 0},
+		{"idempotent replay", chatBody(""), http.Header{"Idempotency-Key": {"replay-1"}}, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			startRequestLogWriter(t)
+			useCredentials(t, testCredentials(1)...)
+			useUpstream(t, func(*http.Request) (*http.Response, error) {
+				return jsonResponse(http.StatusOK, upstreamCompletionWithUsage(12, 5, textElement("hi"))), nil
+			})
+			token := newAPIToken(t)
+
+			header := http.Header{
+				"Authorization": {"Bearer " + token},
+				"Content-Type":  {"application/json"},
+			}
+			for key, values := range tt.header {
+				header[key] = values
+			}
+			for range tt.requests {
+				if w := serve(http.MethodPost, "/v1/chat/completions", tt.body, header); w.Code != http.StatusOK {
+					t.Fatalf("status = %d; body %s", w.Code, w.Body.String())
+				}
+			}
+			StopRequestLogWriter()
+
+			var count int64
+			if err := db.GetDB().Model(&db.RequestLog{}).Where("token_hash = ?", hashAPIToken(token)).Count(&count).Error; err != nil {
+				t.Fatal(err)
+			}
+			if count != int64(tt.wantLogs) {
+				t.Errorf("got %d request logs, want %d", count, tt.wantLogs)
+			}
+		})
+	}
+}